@@ -5,20 +5,36 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
 	SERVER_TYPE = "tcp"
 	BUFFER_SIZE = 2048
+
+	CONTINUE_TIMEOUT = 1 * time.Second
+
+	MAX_RETRIES   = 2
+	MAX_REDIRECTS = 10
 )
 
 type Student struct {
@@ -32,29 +48,158 @@ type GreetResponse struct {
 }
 
 type HttpRequest struct {
+	Scheme         string
 	Method         string
 	Uri            string
 	Version        string
 	Host           string
 	Accept         string
 	AcceptEncoding string
+	ContentType    string
+	Connection     string
+	Headers        map[string]string
+	ChunkSize      int
+	ExpectContinue bool
+	Body           []byte
 }
 
 type HttpResponse struct {
 	Version         string
 	StatusCode      string
+	ReasonPhrase    string
 	ContentType     string
 	ContentEncoding string
 	ContentLength   int
+	Headers         HttpHeaders
 	Data            []byte
 }
 
+type HttpHeader struct {
+	Name  string
+	Value string
+}
+
+type HttpHeaders []HttpHeader
+
+func (h HttpHeaders) Get(name string) string {
+	for _, header := range h {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+func (h HttpHeaders) Values(name string) []string {
+	var values []string
+	for _, header := range h {
+		if strings.EqualFold(header.Name, name) {
+			values = append(values, header.Value)
+		}
+	}
+	return values
+}
+
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	var pairs []string
+	for name, value := range h {
+		pairs = append(pairs, name+": "+value)
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func (h headerFlags) Set(value string) error {
+	name, headerValue, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("header %q must have the form \"Name: Value\"", value)
+	}
+
+	headerValue = strings.TrimSpace(headerValue)
+	if strings.ContainsAny(headerValue, "\r\n") {
+		return fmt.Errorf("invalid value for header %q", name)
+	}
+
+	h[name] = headerValue
+	return nil
+}
+
+type formFlags url.Values
+
+func (f formFlags) String() string {
+	return url.Values(f).Encode()
+}
+
+func (f formFlags) Set(value string) error {
+	name, fieldValue, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("form field %q must have the form name=value", value)
+	}
+
+	url.Values(f).Add(name, fieldValue)
+	return nil
+}
+
+// fileFlags maps a multipart field name to the path of the file sent in it.
+type fileFlags map[string]string
+
+func (f fileFlags) String() string {
+	var pairs []string
+	for field, path := range f {
+		pairs = append(pairs, field+"=@"+path)
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func (f fileFlags) Set(value string) error {
+	field, path, ok := strings.Cut(value, "=@")
+	if !ok || field == "" || path == "" {
+		return fmt.Errorf("file %q must have the form field=@path", value)
+	}
+
+	f[field] = path
+	return nil
+}
+
+var Dialer func(network string, address string) (net.Conn, error) = net.Dial
+
+// TLSConfig is used for https requests; ServerName is filled in per host.
+var TLSConfig = &tls.Config{}
+
 func main() {
+	verbose := flag.Bool("v", false, "print every response header")
+	method := flag.String("X", "GET", "request method")
+	data := flag.String("d", "", "request body, or @file to send a file's contents")
+	bodyType := flag.String("content-type", "", "Content-Type of the request body")
+	dryRun := flag.Bool("dry-run", false, "print the encoded request instead of sending it")
+	repeat := flag.Int("repeat", 1, "send the request this many times over one persistent connection")
+	urlFlag := flag.String("url", "", "request URL (read from stdin when empty)")
+	chunkSize := flag.Int("chunk-size", 0, "send the body with chunked transfer-encoding in chunks of this many bytes (0 sends Content-Length)")
+	expectContinue := flag.Bool("expect-continue", false, "send Expect: 100-continue and hold the body until the server answers")
+	extraHeaders := headerFlags{}
+	flag.Var(extraHeaders, "H", "extra \"Name: Value\" request header (repeatable)")
+	formFields := formFlags{}
+	flag.Var(formFields, "form", "name=value form field sent urlencoded, or multipart with -file (repeatable)")
+	formFiles := fileFlags{}
+	flag.Var(formFiles, "file", "field=@path file sent as multipart/form-data (repeatable)")
+	flag.Parse()
+
+	body, err := readBodyFlag(*data)
+	if err != nil {
+		fmt.Printf("Error reading request body: %v\n", err)
+		return
+	}
+
 	reader := bufio.NewReader(os.Stdin)
 
-	fmt.Print("Input URL: ")
-	inputURL, _ := reader.ReadString('\n')
-	inputURL = strings.TrimSpace(inputURL)
+	inputURL := *urlFlag
+	if inputURL == "" {
+		fmt.Print("Input URL: ")
+		inputURL, _ = reader.ReadString('\n')
+		inputURL = strings.TrimSpace(inputURL)
+	}
 
 	parsedURL, err := url.Parse(inputURL)
 	if err != nil {
@@ -64,6 +209,9 @@ func main() {
 
 	host := parsedURL.Hostname()
 	port := parsedURL.Port()
+	if port == "" {
+		port = defaultPort(parsedURL.Scheme)
+	}
 	uri := parsedURL.Path
 
 	if parsedURL.RawQuery != "" {
@@ -79,58 +227,351 @@ func main() {
 	acceptEncoding = strings.TrimSpace(acceptEncoding)
 
 	httpReq := HttpRequest{
-		Method:         "GET",
+		Scheme:         parsedURL.Scheme,
+		Method:         *method,
 		Uri:            uri,
 		Version:        "HTTP/1.1",
 		Host:           host + ":" + port,
 		Accept:         contentType,
 		AcceptEncoding: acceptEncoding,
+		ContentType:    *bodyType,
+		Headers:        extraHeaders,
+		ChunkSize:      *chunkSize,
+		ExpectContinue: *expectContinue,
+		Body:           body,
 	}
 
-	serverAddr := host + ":" + port
-	connection, err := net.Dial(SERVER_TYPE, serverAddr)
-	if err != nil {
-		fmt.Printf("Error connecting to server: %v\n", err)
+	if len(formFields) > 0 || len(formFiles) > 0 {
+		if len(httpReq.Body) > 0 {
+			fmt.Println("Error: -d cannot be combined with -form or -file")
+			return
+		}
+		httpReq.Body, httpReq.ContentType, err = formBody(url.Values(formFields), formFiles)
+		if err != nil {
+			fmt.Printf("Error building form body: %v\n", err)
+			return
+		}
+		if httpReq.Method == "GET" {
+			httpReq.Method = "POST"
+		}
+	}
+
+	if len(httpReq.Body) > 0 && httpReq.ContentType == "" {
+		httpReq.ContentType = "application/octet-stream"
+		if !strings.HasPrefix(*data, "@") {
+			httpReq.ContentType = "text/plain"
+		}
+	}
+
+	if *dryRun {
+		printDryRun(os.Stdout, httpReq)
+		return
+	}
+
+	if *repeat > 1 {
+		connection, err := dial(httpReq)
+		if err != nil {
+			fmt.Printf("Error connecting to server: %v\n", err)
+			return
+		}
+		defer connection.Close()
+
+		requests := make([]HttpRequest, *repeat)
+		for i := range requests {
+			requests[i] = httpReq
+		}
+
+		for i, response := range FetchSequence(requests, connection) {
+			fmt.Printf("Request %d Status Code: %s (Connection: %s)\n", i+1, response.StatusCode, response.Headers.Get("Connection"))
+		}
 		return
 	}
-	defer connection.Close()
 
-	response := Fetch(httpReq, connection)
+	response, err := Do(httpReq)
+	if err != nil {
+		fmt.Printf("Error fetching %s: %v\n", inputURL, err)
+		return
+	}
 
 	fmt.Printf("Status Code: %s\n", response.StatusCode)
+	if *verbose {
+		printHeaders(os.Stdout, response.Headers)
+	}
 	if response.ContentEncoding != "" && response.ContentEncoding != "none" {
 		fmt.Printf("Encoded: %s\n", response.ContentEncoding)
+		fmt.Println(encodingReport(acceptEncoding, response.ContentEncoding))
 	}
 
-	decodedData := response.Data
-	if response.ContentEncoding == "gzip" {
-		decodedData = decompressGzip(response.Data)
-	} else if response.ContentEncoding == "deflate" {
-		decodedData = decompressDeflate(response.Data)
+	decodedData, err := decodeBody(response.ContentEncoding, response.Data)
+	if err != nil {
+		fmt.Printf("Error decoding response: %v\n", err)
+		return
 	}
 
 	bodyStr := strings.TrimSpace(string(decodedData))
 	fmt.Printf("Body: %s\n", bodyStr)
 
 	if len(decodedData) > 0 {
-		var greetResponse GreetResponse
-		var err error
+		printParsedBody(os.Stdout, response.ContentType, decodedData)
+	}
+}
 
-		if strings.Contains(response.ContentType, "application/json") {
-			err = json.Unmarshal(decodedData, &greetResponse)
-		} else if strings.Contains(response.ContentType, "application/xml") {
-			err = xml.Unmarshal(decodedData, &greetResponse)
+// printParsedBody picks a parser by the exact base media type, so
+// parameters are ignored and lookalikes such as application/json-seq are
+// left alone.
+func printParsedBody(w io.Writer, contentType string, data []byte) {
+	var greetResponse GreetResponse
+	var err error
+
+	mediaType := responseMediaType(contentType)
+	if mediaType == "application/x-ndjson" {
+		printNDJSON(w, data)
+		return
+	}
+
+	if mediaType == "application/json" {
+		err = json.Unmarshal(data, &greetResponse)
+	} else if mediaType == "application/xml" {
+		err = xml.Unmarshal(data, &greetResponse)
+	}
+
+	if err == nil && (mediaType == "application/json" || mediaType == "application/xml") {
+		fmt.Fprintf(w, "Parsed: %v\n", greetResponse)
+	}
+}
+
+// printDryRun writes the bytes a real send would put on the wire, through
+// the same RequestEncoder, without dialing.
+func printDryRun(w io.Writer, req HttpRequest) {
+	fmt.Fprintln(w)
+	w.Write(RequestEncoder(req))
+}
+
+// printHeaders writes every response header in the order it was received.
+func printHeaders(w io.Writer, headers HttpHeaders) {
+	for _, header := range headers {
+		fmt.Fprintf(w, "< %s: %s\n", header.Name, header.Value)
+	}
+}
+
+func printNDJSON(w io.Writer, data []byte) {
+	for i, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var object map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &object); err != nil {
+			fmt.Fprintf(w, "Error parsing line %d: %v\n", i+1, err)
+			continue
+		}
+		fmt.Fprintf(w, "Parsed line %d: %v\n", i+1, object)
+	}
+}
+
+func responseMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// Do sends req over a new connection, using TLS for the https scheme, and
+// follows up to MAX_REDIRECTS redirects, resolving relative Location values
+// against the URL that was requested.
+func Do(req HttpRequest) (HttpResponse, error) {
+	for redirects := 0; ; redirects++ {
+		response, err := send(req)
+		if err != nil {
+			return response, err
 		}
 
-		if err == nil && (strings.Contains(response.ContentType, "application/json") || strings.Contains(response.ContentType, "application/xml")) {
-			fmt.Printf("Parsed: %v\n", greetResponse)
+		location := response.Headers.Get("Location")
+		if !isRedirect(response.StatusCode) || location == "" {
+			return response, nil
 		}
+		if redirects == MAX_REDIRECTS {
+			return response, fmt.Errorf("stopped after %d redirects", MAX_REDIRECTS)
+		}
+
+		req, err = redirectRequest(req, response.StatusCode, location)
+		if err != nil {
+			return response, err
+		}
+	}
+}
+
+// send retries idempotent requests up to MAX_RETRIES times when the
+// connection fails or closes without a response.
+func send(req HttpRequest) (HttpResponse, error) {
+	var err error
+
+	for attempt := 0; attempt <= MAX_RETRIES; attempt++ {
+		var response HttpResponse
+		response, err = roundTrip(req)
+		if err == nil {
+			return response, nil
+		}
+		if !isIdempotent(req.Method) {
+			break
+		}
+	}
+
+	return HttpResponse{}, err
+}
+
+func roundTrip(req HttpRequest) (HttpResponse, error) {
+	connection, err := dial(req)
+	if err != nil {
+		return HttpResponse{}, fmt.Errorf("connecting to server: %w", err)
+	}
+	defer connection.Close()
+
+	response := Fetch(req, connection)
+	if response.StatusCode == "" {
+		return response, fmt.Errorf("no valid response from %s", req.Host)
+	}
+
+	return response, nil
+}
+
+func isRedirect(statusCode string) bool {
+	switch statusCode {
+	case "301", "302", "303", "307", "308":
+		return true
+	}
+	return false
+}
+
+// redirectRequest builds the request for location. 303, and 301/302 after
+// a POST, switch to a bodyless GET; 307 and 308 resend the request as is.
+func redirectRequest(req HttpRequest, statusCode string, location string) (HttpRequest, error) {
+	scheme := req.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	base, err := url.Parse(scheme + "://" + req.Host + req.Uri)
+	if err != nil {
+		return req, fmt.Errorf("parsing request URL: %w", err)
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return req, fmt.Errorf("parsing Location %q: %w", location, err)
+	}
+
+	target := base.ResolveReference(ref)
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return req, fmt.Errorf("cannot follow redirect to %s", target)
+	}
+
+	port := target.Port()
+	if port == "" {
+		port = defaultPort(target.Scheme)
+	}
+
+	next := req
+	next.Scheme = target.Scheme
+	next.Host = net.JoinHostPort(target.Hostname(), port)
+	next.Uri = target.RequestURI()
+
+	if statusCode == "303" || (req.Method == "POST" && (statusCode == "301" || statusCode == "302")) {
+		if req.Method != "HEAD" {
+			next.Method = "GET"
+		}
+		next.ContentType = ""
+		next.ChunkSize = 0
+		next.ExpectContinue = false
+		next.Body = nil
+	}
+
+	// Credentials meant for one host are not forwarded to another.
+	if next.Host != req.Host {
+		next.Headers = make(map[string]string, len(req.Headers))
+		for name, value := range req.Headers {
+			if !strings.EqualFold(name, "Authorization") {
+				next.Headers[name] = value
+			}
+		}
+	}
+
+	return next, nil
+}
+
+func dial(req HttpRequest) (net.Conn, error) {
+	connection, err := Dialer(SERVER_TYPE, req.Host)
+	if err != nil || !strings.EqualFold(req.Scheme, "https") {
+		return connection, err
+	}
+
+	config := TLSConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(req.Host)
+	}
+
+	tlsConnection := tls.Client(connection, config)
+	if err := tlsConnection.Handshake(); err != nil {
+		connection.Close()
+		return nil, fmt.Errorf("TLS handshake: %w", err)
 	}
+	return tlsConnection, nil
+}
+
+func defaultPort(scheme string) string {
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+// isIdempotent lists the methods RFC 9110 section 9.2.2 allows a client to
+// resend automatically.
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func FetchSequence(reqs []HttpRequest, connection net.Conn) []HttpResponse {
+	var responses []HttpResponse
+
+	for i, req := range reqs {
+		req.Connection = "keep-alive"
+		if i == len(reqs)-1 {
+			req.Connection = "close"
+		}
+
+		response := Fetch(req, connection)
+		responses = append(responses, response)
+
+		if response.StatusCode == "" || strings.EqualFold(response.Headers.Get("Connection"), "close") {
+			break
+		}
+	}
+
+	return responses
 }
 
 func Fetch(req HttpRequest, connection net.Conn) HttpResponse {
 	requestBytes := RequestEncoder(req)
 
+	// With Expect: 100-continue the body waits for the server's interim
+	// response, or for CONTINUE_TIMEOUT if the server never sends one.
+	var heldBody []byte
+	if req.ExpectContinue && len(req.Body) > 0 {
+		headEnd := bytes.Index(requestBytes, []byte("\r\n\r\n")) + len("\r\n\r\n")
+		requestBytes, heldBody = requestBytes[:headEnd], requestBytes[headEnd:]
+		connection.SetReadDeadline(time.Now().Add(CONTINUE_TIMEOUT))
+	}
+	sendHeldBody := func() error {
+		if heldBody == nil {
+			return nil
+		}
+		connection.SetReadDeadline(time.Time{})
+		_, err := connection.Write(heldBody)
+		heldBody = nil
+		return err
+	}
+
 	_, err := connection.Write(requestBytes)
 	if err != nil {
 		fmt.Printf("Error sending request: %v\n", err)
@@ -140,45 +581,83 @@ func Fetch(req HttpRequest, connection net.Conn) HttpResponse {
 	buffer := make([]byte, BUFFER_SIZE)
 	var responseData []byte
 
+	headerEndIndex := -1
+	contentLength := -1
+	chunked := false
+	var chunks chunkDecoder
+	bodyless := req.Method == "HEAD"
+
 	for {
+		// Read may return the final bytes together with an error, so keep
+		// them before looking at err.
 		n, err := connection.Read(buffer)
-		if err != nil {
-			if n == 0 {
+		responseData = append(responseData, buffer[:n]...)
+		if heldBody != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+			if err := sendHeldBody(); err != nil {
+				fmt.Printf("Error sending request body: %v\n", err)
 				break
 			}
-			fmt.Printf("Error reading response: %v\n", err)
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("Error reading response: %v\n", err)
+			}
 			break
 		}
-		responseData = append(responseData, buffer[:n]...)
 
-		responseStr := string(responseData)
-		if strings.Contains(responseStr, "\r\n\r\n") {
-			headerEndIndex := strings.Index(responseStr, "\r\n\r\n")
-			headers := responseStr[:headerEndIndex]
+		if headerEndIndex == -1 {
+			headerEndIndex = bytes.Index(responseData, []byte("\r\n\r\n"))
+			for headerEndIndex != -1 && isInterimResponse(responseData) {
+				responseData = responseData[headerEndIndex+len("\r\n\r\n"):]
+				headerEndIndex = bytes.Index(responseData, []byte("\r\n\r\n"))
+				if err := sendHeldBody(); err != nil {
+					fmt.Printf("Error sending request body: %v\n", err)
+					return HttpResponse{}
+				}
+			}
+			if headerEndIndex == -1 {
+				continue
+			}
 
-			contentLength := 0
-			headerLines := strings.Split(headers, "\r\n")
+			// A final response before 100 Continue rejects the request, so
+			// the held body is never sent.
+			if heldBody != nil {
+				heldBody = nil
+				connection.SetReadDeadline(time.Time{})
+			}
+
+			headerLines := strings.Split(string(responseData[:headerEndIndex]), "\r\n")
+			if statusParts := strings.Fields(headerLines[0]); len(statusParts) >= 2 && (statusParts[1] == "204" || statusParts[1] == "304") {
+				bodyless = true
+			}
 			for _, line := range headerLines {
-				if strings.HasPrefix(strings.ToLower(line), "content-length:") {
-					parts := strings.SplitN(line, ":", 2)
-					if len(parts) == 2 {
-						if length, err := strconv.Atoi(strings.TrimSpace(parts[1])); err == nil {
-							contentLength = length
-						}
+				name, value, _ := strings.Cut(line, ":")
+				switch strings.ToLower(strings.TrimSpace(name)) {
+				case "content-length":
+					if length, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+						contentLength = length
 					}
-					break
+				case "transfer-encoding":
+					chunked = strings.EqualFold(strings.TrimSpace(value), "chunked")
 				}
 			}
+		}
 
-			bodyStart := headerEndIndex + 4
-			currentBodyLength := len(responseData) - bodyStart
+		if bodyless {
+			break
+		}
 
-			if contentLength == 0 || currentBodyLength >= contentLength {
+		// Transfer-Encoding overrides any Content-Length (RFC 9112 section 6.3).
+		bodyStart := headerEndIndex + len("\r\n\r\n")
+		if chunked {
+			if done, err := chunks.advance(responseData[bodyStart:]); done || err != nil {
 				break
 			}
+			continue
 		}
 
-		if n < BUFFER_SIZE {
+		if contentLength >= 0 && len(responseData)-bodyStart >= contentLength {
 			break
 		}
 	}
@@ -186,56 +665,128 @@ func Fetch(req HttpRequest, connection net.Conn) HttpResponse {
 	return ResponseDecoder(responseData)
 }
 
+// isInterimResponse reports whether data starts with a 1xx status line.
+func isInterimResponse(data []byte) bool {
+	statusParts := strings.Fields(string(data[:max(bytes.IndexByte(data, '\n'), 0)]))
+	return len(statusParts) >= 2 && len(statusParts[1]) == 3 && statusParts[1][0] == '1'
+}
+
 func ResponseDecoder(bytestream []byte) HttpResponse {
-	responseStr := string(bytestream)
-	lines := strings.Split(responseStr, "\r\n")
+	head := bytestream
+	headerEndIndex := bytes.Index(bytestream, []byte("\r\n\r\n"))
+	if headerEndIndex != -1 {
+		head = bytestream[:headerEndIndex]
+	}
+	lines := strings.Split(string(head), "\r\n")
 
 	response := HttpResponse{}
 
 	if len(lines) > 0 {
-		statusParts := strings.Split(lines[0], " ")
-		if len(statusParts) >= 3 {
+		statusParts := strings.SplitN(lines[0], " ", 3)
+		if len(statusParts) >= 2 {
 			response.Version = statusParts[0]
 			response.StatusCode = statusParts[1]
 		}
+		if len(statusParts) == 3 {
+			response.ReasonPhrase = statusParts[2]
+		}
 	}
 
-	headerEndIndex := 0
-	for i, line := range lines {
-		if line == "" {
-			headerEndIndex = i
-			break
+	for _, line := range lines[1:] {
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			response.Headers = append(response.Headers, HttpHeader{Name: name, Value: strings.TrimSpace(value)})
 		}
+	}
 
-		if i == 0 {
-			continue
+	response.ContentType = response.Headers.Get("Content-Type")
+	response.ContentEncoding = response.Headers.Get("Content-Encoding")
+	if length, err := strconv.Atoi(response.Headers.Get("Content-Length")); err == nil {
+		response.ContentLength = length
+	}
+
+	if headerEndIndex != -1 {
+		response.Data = bytestream[headerEndIndex+4:]
+	}
+
+	if strings.EqualFold(response.Headers.Get("Transfer-Encoding"), "chunked") {
+		decoded, err := dechunk(response.Data)
+		if err != nil {
+			fmt.Printf("Error decoding chunked body: %v\n", err)
+		} else {
+			response.Data = decoded
+			response.ContentLength = len(decoded)
 		}
+	}
 
-		headerParts := strings.SplitN(line, ": ", 2)
-		if len(headerParts) == 2 {
-			headerName := strings.ToLower(headerParts[0])
-			headerValue := headerParts[1]
+	return response
+}
 
-			switch headerName {
-			case "content-type":
-				response.ContentType = headerValue
-			case "content-encoding":
-				response.ContentEncoding = headerValue
-			case "content-length":
-				if length, err := strconv.Atoi(headerValue); err == nil {
-					response.ContentLength = length
-				}
+var errIncompleteChunk = errors.New("incomplete chunked body")
+
+// chunkDecoder decodes a chunked body as it arrives. Each advance resumes
+// at offset and only consumes complete size lines, chunks and trailers, so
+// a body read in many pieces is decoded in linear time.
+type chunkDecoder struct {
+	body     []byte
+	offset   int
+	trailers bool
+}
+
+// advance decodes what it can of data, which must extend the data passed
+// before. It reports true once the last chunk and trailer section are in.
+func (d *chunkDecoder) advance(data []byte) (bool, error) {
+	crlf := []byte("\r\n")
+
+	for {
+		lineEnd := bytes.Index(data[d.offset:], crlf)
+		if lineEnd == -1 {
+			return false, nil
+		}
+
+		if d.trailers {
+			d.offset += lineEnd + 2
+			if lineEnd == 0 {
+				return true, nil
 			}
+			continue
+		}
+
+		sizeField, _, _ := strings.Cut(string(data[d.offset:d.offset+lineEnd]), ";")
+		size, err := strconv.ParseUint(strings.TrimRight(sizeField, " \t"), 16, 62)
+		if err != nil {
+			return false, fmt.Errorf("invalid chunk size %q", sizeField)
+		}
+		if size == 0 {
+			d.trailers = true
+			d.offset += lineEnd + 2
+			continue
+		}
+
+		start := d.offset + lineEnd + 2
+		if uint64(len(data)-start) < size+2 {
+			return false, nil
+		}
+		end := start + int(size)
+		if !bytes.Equal(data[end:end+2], crlf) {
+			return false, fmt.Errorf("missing CRLF after %d byte chunk", size)
 		}
-	}
 
-	if headerEndIndex < len(lines)-1 {
-		bodyLines := lines[headerEndIndex+1:]
-		body := strings.Join(bodyLines, "\r\n")
-		response.Data = []byte(body)
+		d.body = append(d.body, data[start:end]...)
+		d.offset = end + 2
 	}
+}
 
-	return response
+func dechunk(body []byte) ([]byte, error) {
+	var decoder chunkDecoder
+
+	done, err := decoder.advance(body)
+	if err != nil {
+		return nil, err
+	}
+	if !done {
+		return nil, errIncompleteChunk
+	}
+	return decoder.body, nil
 }
 
 func RequestEncoder(req HttpRequest) []byte {
@@ -245,15 +796,168 @@ func RequestEncoder(req HttpRequest) []byte {
 
 	requestBuilder.WriteString(fmt.Sprintf("Host: %s\r\n", req.Host))
 
-	requestBuilder.WriteString(fmt.Sprintf("Accept: %s\r\n", req.Accept))
+	if req.Accept != "" {
+		requestBuilder.WriteString(fmt.Sprintf("Accept: %s\r\n", req.Accept))
+	}
 
-	if req.AcceptEncoding != "none" {
+	if req.AcceptEncoding != "" && req.AcceptEncoding != "none" {
 		requestBuilder.WriteString(fmt.Sprintf("Accept-Encoding: %s\r\n", req.AcceptEncoding))
 	}
 
+	if req.Connection != "" {
+		requestBuilder.WriteString(fmt.Sprintf("Connection: %s\r\n", req.Connection))
+	}
+
+	if req.ContentType != "" {
+		requestBuilder.WriteString(fmt.Sprintf("Content-Type: %s\r\n", req.ContentType))
+	}
+
+	headerNames := make([]string, 0, len(req.Headers))
+	for name := range req.Headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	for _, name := range headerNames {
+		requestBuilder.WriteString(fmt.Sprintf("%s: %s\r\n", name, req.Headers[name]))
+	}
+
+	if req.ExpectContinue && len(req.Body) > 0 {
+		requestBuilder.WriteString("Expect: 100-continue\r\n")
+	}
+
+	chunked := req.ChunkSize > 0 && len(req.Body) > 0
+	if chunked {
+		requestBuilder.WriteString("Transfer-Encoding: chunked\r\n")
+	} else if len(req.Body) > 0 || req.Method == "POST" || req.Method == "PUT" {
+		requestBuilder.WriteString(fmt.Sprintf("Content-Length: %d\r\n", len(req.Body)))
+	}
+
 	requestBuilder.WriteString("\r\n")
 
-	return []byte(requestBuilder.String())
+	request := []byte(requestBuilder.String())
+	if !chunked {
+		return append(request, req.Body...)
+	}
+
+	for data := req.Body; len(data) > 0; {
+		chunk := data[:min(len(data), req.ChunkSize)]
+		request = append(request, fmt.Sprintf("%x\r\n", len(chunk))...)
+		request = append(request, chunk...)
+		request = append(request, "\r\n"...)
+		data = data[len(chunk):]
+	}
+	return append(request, "0\r\n\r\n"...)
+}
+
+// formBody encodes fields as application/x-www-form-urlencoded, or as
+// multipart/form-data once files are attached, and returns the body with
+// its Content-Type. Fields and files are written in name order.
+func formBody(fields url.Values, files fileFlags) ([]byte, string, error) {
+	if len(files) == 0 {
+		return []byte(fields.Encode()), "application/x-www-form-urlencoded", nil
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range fields[name] {
+			writer.WriteField(name, value)
+		}
+	}
+
+	names = names[:0]
+	for field := range files {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	for _, field := range names {
+		data, err := os.ReadFile(files[field])
+		if err != nil {
+			return nil, "", err
+		}
+		part, err := writer.CreateFormFile(field, filepath.Base(files[field]))
+		if err != nil {
+			return nil, "", err
+		}
+		part.Write(data)
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), writer.FormDataContentType(), nil
+}
+
+func readBodyFlag(data string) ([]byte, error) {
+	if path, ok := strings.CutPrefix(data, "@"); ok {
+		return os.ReadFile(path)
+	}
+	return []byte(data), nil
+}
+
+func decodeBody(encoding string, data []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "br":
+		return decompressBrotli(data), nil
+	case "gzip":
+		return decompressGzip(data), nil
+	case "deflate":
+		return decompressDeflate(data), nil
+	case "zstd":
+		return decompressZstd(data), nil
+	case "", "none", "identity":
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding: %s", encoding)
+	}
+}
+
+func encodingReport(acceptEncoding string, encoding string) string {
+	if encodingOffered(acceptEncoding, encoding) {
+		return fmt.Sprintf("Negotiated encoding %s matches requested \"%s\"", encoding, acceptEncoding)
+	}
+	return fmt.Sprintf("Warning: server chose encoding %s which was not requested in \"%s\"", encoding, acceptEncoding)
+}
+
+// encodingOffered reports whether acceptEncoding allows encoding. A coding
+// listed with q=0 is refused, and a named coding overrides "*".
+func encodingOffered(acceptEncoding string, encoding string) bool {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	wildcard := false
+
+	for _, element := range strings.Split(strings.ToLower(acceptEncoding), ",") {
+		coding, params, _ := strings.Cut(element, ";")
+		coding = strings.TrimSpace(coding)
+
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(name) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				parsed = 0
+			}
+			quality = parsed
+		}
+
+		if coding == encoding {
+			return quality > 0
+		}
+		if coding == "*" {
+			wildcard = quality > 0
+		}
+	}
+
+	return wildcard
 }
 
 func decompressGzip(data []byte) []byte {
@@ -285,3 +989,30 @@ func decompressDeflate(data []byte) []byte {
 
 	return decompressed
 }
+
+func decompressBrotli(data []byte) []byte {
+	decompressed, err := io.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		fmt.Printf("Error decompressing brotli data: %v\n", err)
+		return data
+	}
+
+	return decompressed
+}
+
+func decompressZstd(data []byte) []byte {
+	reader, err := zstd.NewReader(bytes.NewReader(data))
+	if err != nil {
+		fmt.Printf("Error creating zstd reader: %v\n", err)
+		return data
+	}
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		fmt.Printf("Error decompressing zstd data: %v\n", err)
+		return data
+	}
+
+	return decompressed
+}
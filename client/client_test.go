@@ -0,0 +1,1205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestRequestEncoder(t *testing.T) {
+	tests := []struct {
+		name string
+		req  HttpRequest
+		want string
+	}{
+		{
+			name: "without accept-encoding",
+			req: HttpRequest{
+				Method:  "GET",
+				Uri:     "/greet/2306216636",
+				Version: "HTTP/1.1",
+				Host:    "localhost:6636",
+				Accept:  "application/json",
+			},
+			want: "GET /greet/2306216636 HTTP/1.1\r\n" +
+				"Host: localhost:6636\r\n" +
+				"Accept: application/json\r\n" +
+				"\r\n",
+		},
+		{
+			name: "none sends no accept-encoding",
+			req: HttpRequest{
+				Method:         "GET",
+				Uri:            "/",
+				Version:        "HTTP/1.1",
+				Host:           "localhost:6636",
+				AcceptEncoding: "none",
+			},
+			want: "GET / HTTP/1.1\r\n" +
+				"Host: localhost:6636\r\n" +
+				"\r\n",
+		},
+		{
+			name: "with accept-encoding",
+			req: HttpRequest{
+				Method:         "GET",
+				Uri:            "/gzip-test?size=10",
+				Version:        "HTTP/1.1",
+				Host:           "localhost:6636",
+				Accept:         "text/plain",
+				AcceptEncoding: "gzip, br;q=0.5",
+				Connection:     "close",
+			},
+			want: "GET /gzip-test?size=10 HTTP/1.1\r\n" +
+				"Host: localhost:6636\r\n" +
+				"Accept: text/plain\r\n" +
+				"Accept-Encoding: gzip, br;q=0.5\r\n" +
+				"Connection: close\r\n" +
+				"\r\n",
+		},
+		{
+			name: "body with sorted extra headers",
+			req: HttpRequest{
+				Method:      "POST",
+				Uri:         "/echo",
+				Version:     "HTTP/1.1",
+				Host:        "localhost:6636",
+				ContentType: "text/plain",
+				Headers:     map[string]string{"X-Request-Id": "abc", "Authorization": "Bearer t"},
+				Body:        []byte("hello"),
+			},
+			want: "POST /echo HTTP/1.1\r\n" +
+				"Host: localhost:6636\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"Authorization: Bearer t\r\n" +
+				"X-Request-Id: abc\r\n" +
+				"Content-Length: 5\r\n" +
+				"\r\n" +
+				"hello",
+		},
+		{
+			name: "empty post still sends content-length",
+			req: HttpRequest{
+				Method:  "POST",
+				Uri:     "/echo",
+				Version: "HTTP/1.1",
+				Host:    "localhost:6636",
+			},
+			want: "POST /echo HTTP/1.1\r\n" +
+				"Host: localhost:6636\r\n" +
+				"Content-Length: 0\r\n" +
+				"\r\n",
+		},
+		{
+			name: "expect continue",
+			req: HttpRequest{
+				Method:         "POST",
+				Uri:            "/echo",
+				Version:        "HTTP/1.1",
+				Host:           "localhost:6636",
+				ExpectContinue: true,
+				Body:           []byte("hi"),
+			},
+			want: "POST /echo HTTP/1.1\r\n" +
+				"Host: localhost:6636\r\n" +
+				"Expect: 100-continue\r\n" +
+				"Content-Length: 2\r\n" +
+				"\r\n" +
+				"hi",
+		},
+		{
+			name: "chunked body",
+			req: HttpRequest{
+				Method:    "PUT",
+				Uri:       "/echo",
+				Version:   "HTTP/1.1",
+				Host:      "localhost:6636",
+				ChunkSize: 4,
+				Body:      []byte("hello world"),
+			},
+			want: "PUT /echo HTTP/1.1\r\n" +
+				"Host: localhost:6636\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"4\r\nhell\r\n" +
+				"4\r\no wo\r\n" +
+				"3\r\nrld\r\n" +
+				"0\r\n\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RequestEncoder(tt.req); string(got) != tt.want {
+				t.Errorf("RequestEncoder() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDechunk(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		err     error
+		wantErr bool
+	}{
+		{name: "complete", data: "5\r\nhello\r\n0\r\n\r\n", want: "hello"},
+		{name: "extension and trailer", data: "2;x=y\r\nhi\r\n0\r\nX-Checksum: 1\r\n\r\n", want: "hi"},
+		{name: "incomplete", data: "5\r\nhel", err: errIncompleteChunk},
+		{name: "missing trailer end", data: "0\r\n", err: errIncompleteChunk},
+		{name: "bad size", data: "zz\r\n", wantErr: true},
+		{name: "signed size", data: "+5\r\nhello\r\n0\r\n\r\n", wantErr: true},
+		{name: "missing crlf", data: "2\r\nhiX\r\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := dechunk([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil || err == errIncompleteChunk {
+					t.Fatalf("dechunk() error = %v, want a framing error", err)
+				}
+				return
+			}
+			if err != tt.err || string(got) != tt.want {
+				t.Errorf("dechunk() = %q, %v, want %q, %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestFetchChunkedInPieces(t *testing.T) {
+	body := bytes.Repeat([]byte("Halo, dunia! "), 500)
+	var response []byte
+	response = append(response, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"...)
+	for data := body; len(data) > 0; data = data[min(len(data), 100):] {
+		chunk := data[:min(len(data), 100)]
+		response = append(response, strconv.FormatInt(int64(len(chunk)), 16)+"\r\n"...)
+		response = append(response, chunk...)
+		response = append(response, "\r\n"...)
+	}
+	response = append(response, "0\r\n\r\n"...)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		serverConn.Read(make([]byte, BUFFER_SIZE))
+		for _, b := range response {
+			serverConn.Write([]byte{b})
+		}
+	}()
+
+	res := Fetch(HttpRequest{Method: "GET", Uri: "/", Version: "HTTP/1.1", Host: "example"}, clientConn)
+	if !bytes.Equal(res.Data, body) {
+		t.Errorf("Data has %d bytes, want %d", len(res.Data), len(body))
+	}
+}
+
+func TestEncodingReport(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+		want           string
+	}{
+		{"gzip, deflate", "deflate", `Negotiated encoding deflate matches requested "gzip, deflate"`},
+		{"gzip, deflate;q=0", "deflate", `Warning: server chose encoding deflate which was not requested in "gzip, deflate;q=0"`},
+	}
+
+	for _, tt := range tests {
+		if got := encodingReport(tt.acceptEncoding, tt.encoding); got != tt.want {
+			t.Errorf("encodingReport(%q, %q) = %q, want %q", tt.acceptEncoding, tt.encoding, got, tt.want)
+		}
+	}
+}
+
+func TestFetchExpectContinue(t *testing.T) {
+	tests := []struct {
+		name    string
+		interim string
+		final   string
+		status  string
+		sent    string
+	}{
+		{
+			name:    "body follows 100 continue",
+			interim: "HTTP/1.1 100 Continue\r\n\r\n",
+			final:   "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok",
+			status:  "200",
+			sent:    "hello",
+		},
+		{
+			name:   "final response withholds the body",
+			final:  "HTTP/1.1 417 Expectation Failed\r\nContent-Length: 0\r\n\r\n",
+			status: "417",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+
+			received := make(chan string, 1)
+			go func() {
+				defer serverConn.Close()
+				head := make([]byte, BUFFER_SIZE)
+				n, _ := serverConn.Read(head)
+				if !bytes.HasSuffix(head[:n], []byte("\r\n\r\n")) {
+					received <- "body sent with the head: " + string(head[:n])
+					return
+				}
+
+				var body []byte
+				if tt.interim != "" {
+					serverConn.Write([]byte(tt.interim))
+					n, _ = serverConn.Read(head)
+					body = head[:n]
+				}
+				serverConn.Write([]byte(tt.final))
+				received <- string(body)
+			}()
+
+			req := HttpRequest{Method: "POST", Uri: "/echo", Version: "HTTP/1.1", Host: "example", ExpectContinue: true, Body: []byte("hello")}
+			res := Fetch(req, clientConn)
+			if res.StatusCode != tt.status {
+				t.Errorf("StatusCode = %q, want %q", res.StatusCode, tt.status)
+			}
+			if got := <-received; got != tt.sent {
+				t.Errorf("server received body %q, want %q", got, tt.sent)
+			}
+		})
+	}
+}
+
+func TestFetchExpectContinueTimeout(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		defer serverConn.Close()
+		head := make([]byte, BUFFER_SIZE)
+		serverConn.Read(head)
+		n, _ := serverConn.Read(head)
+		serverConn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(n) + "\r\n\r\n"))
+		serverConn.Write(head[:n])
+	}()
+
+	start := time.Now()
+	res := Fetch(HttpRequest{Method: "POST", Uri: "/echo", Version: "HTTP/1.1", Host: "example", ExpectContinue: true, Body: []byte("hello")}, clientConn)
+	if res.StatusCode != "200" || string(res.Data) != "hello" {
+		t.Errorf("got %s %q, want 200 hello", res.StatusCode, res.Data)
+	}
+	if elapsed := time.Since(start); elapsed < CONTINUE_TIMEOUT {
+		t.Errorf("body sent after %v, want at least %v", elapsed, CONTINUE_TIMEOUT)
+	}
+}
+
+// dialStep scripts one Dialer call: fail with err, or answer the request
+// with response ("" closes the connection without answering).
+type dialStep struct {
+	err      error
+	response string
+}
+
+// fakeNetwork records what the client dialed and the request heads it sent.
+type fakeNetwork struct {
+	sync.Mutex
+	dialed   []string
+	requests []string
+}
+
+func (n *fakeNetwork) dials() []string {
+	n.Lock()
+	defer n.Unlock()
+	return append([]string(nil), n.dialed...)
+}
+
+func (n *fakeNetwork) requestLines() []string {
+	n.Lock()
+	defer n.Unlock()
+
+	var lines []string
+	for _, request := range n.requests {
+		line, _, _ := strings.Cut(request, "\r\n")
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// fakeDialer replaces Dialer for the test with one that follows steps.
+func fakeDialer(t *testing.T, steps ...dialStep) *fakeNetwork {
+	t.Helper()
+	network := &fakeNetwork{}
+
+	original := Dialer
+	t.Cleanup(func() { Dialer = original })
+
+	Dialer = func(_ string, address string) (net.Conn, error) {
+		network.Lock()
+		defer network.Unlock()
+
+		network.dialed = append(network.dialed, address)
+		if len(network.dialed) > len(steps) {
+			return nil, errors.New("unexpected dial")
+		}
+		step := steps[len(network.dialed)-1]
+		if step.err != nil {
+			return nil, step.err
+		}
+
+		clientConn, serverConn := net.Pipe()
+		go serveOnce(serverConn, step.response, func(request []byte) {
+			network.Lock()
+			network.requests = append(network.requests, string(request))
+			network.Unlock()
+		})
+		return clientConn, nil
+	}
+
+	return network
+}
+
+func TestDoRetries(t *testing.T) {
+	refused := errors.New("connection refused")
+	ok := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+	tests := []struct {
+		name    string
+		method  string
+		steps   []dialStep
+		wantErr bool
+		dials   int
+	}{
+		{name: "first attempt", method: "GET", steps: []dialStep{{response: ok}}, dials: 1},
+		{name: "dial failures", method: "GET", steps: []dialStep{{err: refused}, {err: refused}, {response: ok}}, dials: 3},
+		{name: "closed without response", method: "PUT", steps: []dialStep{{}, {response: ok}}, dials: 2},
+		{name: "gives up", method: "GET", steps: []dialStep{{err: refused}, {err: refused}, {err: refused}}, wantErr: true, dials: MAX_RETRIES + 1},
+		{name: "post is not retried", method: "POST", steps: []dialStep{{err: refused}, {response: ok}}, wantErr: true, dials: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := fakeDialer(t, tt.steps...)
+
+			res, err := Do(HttpRequest{Method: tt.method, Uri: "/", Version: "HTTP/1.1", Host: "example:80"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(res.Data) != "ok" {
+				t.Errorf("Data = %q, want ok", res.Data)
+			}
+			if dials := network.dials(); len(dials) != tt.dials {
+				t.Errorf("dialed %d times, want %d", len(dials), tt.dials)
+			}
+		})
+	}
+}
+
+func TestDoRedirects(t *testing.T) {
+	redirect := func(status string, location string) dialStep {
+		return dialStep{response: "HTTP/1.1 " + status + " Redirect\r\nLocation: " + location + "\r\nContent-Length: 0\r\n\r\n"}
+	}
+	ok := dialStep{response: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"}
+
+	tests := []struct {
+		name    string
+		method  string
+		steps   []dialStep
+		dials   []string
+		lines   []string
+		wantErr bool
+	}{
+		{
+			name:   "relative location",
+			method: "GET",
+			steps:  []dialStep{redirect("301", "/greet/2306216636?name=a"), ok},
+			dials:  []string{"localhost:6636", "localhost:6636"},
+			lines:  []string{"GET /old HTTP/1.1", "GET /greet/2306216636?name=a HTTP/1.1"},
+		},
+		{
+			name:   "dot segments",
+			method: "GET",
+			steps:  []dialStep{redirect("302", "../health"), ok},
+			dials:  []string{"localhost:6636", "localhost:6636"},
+			lines:  []string{"GET /old HTTP/1.1", "GET /health HTTP/1.1"},
+		},
+		{
+			name:   "other host",
+			method: "GET",
+			steps:  []dialStep{redirect("307", "http://example.com/x"), ok},
+			dials:  []string{"localhost:6636", "example.com:80"},
+			lines:  []string{"GET /old HTTP/1.1", "GET /x HTTP/1.1"},
+		},
+		{
+			name:   "303 turns post into get",
+			method: "POST",
+			steps:  []dialStep{redirect("303", "/done"), ok},
+			dials:  []string{"localhost:6636", "localhost:6636"},
+			lines:  []string{"POST /old HTTP/1.1", "GET /done HTTP/1.1"},
+		},
+		{
+			name:   "308 keeps the method",
+			method: "PUT",
+			steps:  []dialStep{redirect("308", "/new"), ok},
+			dials:  []string{"localhost:6636", "localhost:6636"},
+			lines:  []string{"PUT /old HTTP/1.1", "PUT /new HTTP/1.1"},
+		},
+		{
+			name:    "unsupported scheme",
+			method:  "GET",
+			steps:   []dialStep{redirect("302", "ftp://example.com/")},
+			dials:   []string{"localhost:6636"},
+			lines:   []string{"GET /old HTTP/1.1"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network := fakeDialer(t, tt.steps...)
+
+			req := HttpRequest{Method: tt.method, Uri: "/old", Version: "HTTP/1.1", Host: "localhost:6636", Body: []byte("x")}
+			res, err := Do(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(res.Data) != "ok" {
+				t.Errorf("Data = %q, want ok", res.Data)
+			}
+			if got := strings.Join(network.dials(), " "); got != strings.Join(tt.dials, " ") {
+				t.Errorf("dialed %s, want %s", got, strings.Join(tt.dials, " "))
+			}
+			if got := strings.Join(network.requestLines(), "; "); got != strings.Join(tt.lines, "; ") {
+				t.Errorf("requests %s, want %s", got, strings.Join(tt.lines, "; "))
+			}
+		})
+	}
+}
+
+func TestDoRedirectLimit(t *testing.T) {
+	steps := make([]dialStep, MAX_REDIRECTS+1)
+	for i := range steps {
+		steps[i] = dialStep{response: "HTTP/1.1 302 Found\r\nLocation: /loop\r\nContent-Length: 0\r\n\r\n"}
+	}
+	fakeDialer(t, steps...)
+
+	if _, err := Do(HttpRequest{Method: "GET", Uri: "/loop", Version: "HTTP/1.1", Host: "localhost:6636"}); err == nil {
+		t.Error("Do() followed a redirect loop without an error")
+	}
+}
+
+func TestRedirectRequest(t *testing.T) {
+	req := HttpRequest{
+		Method:  "POST",
+		Uri:     "/a/b?x=1",
+		Version: "HTTP/1.1",
+		Host:    "localhost:6636",
+		Headers: map[string]string{"Authorization": "Bearer secret", "X-Trace": "1"},
+		Body:    []byte("data"),
+	}
+
+	tests := []struct {
+		name     string
+		status   string
+		location string
+		scheme   string
+		host     string
+		uri      string
+		method   string
+		auth     bool
+	}{
+		{"relative path", "307", "c", "http", "localhost:6636", "/a/c", "POST", true},
+		{"absolute path", "308", "/z?y=2", "http", "localhost:6636", "/z?y=2", "POST", true},
+		{"http to https", "301", "https://localhost/secure", "https", "localhost:443", "/secure", "GET", false},
+		{"scheme relative", "302", "//example.com:8080/p", "http", "example.com:8080", "/p", "GET", false},
+		{"see other", "303", "/done", "http", "localhost:6636", "/done", "GET", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, err := redirectRequest(req, tt.status, tt.location)
+			if err != nil {
+				t.Fatalf("redirectRequest() error = %v", err)
+			}
+			if next.Scheme != tt.scheme || next.Host != tt.host || next.Uri != tt.uri || next.Method != tt.method {
+				t.Errorf("got %s://%s%s %s, want %s://%s%s %s", next.Scheme, next.Host, next.Uri, next.Method, tt.scheme, tt.host, tt.uri, tt.method)
+			}
+			if _, ok := next.Headers["Authorization"]; ok != tt.auth {
+				t.Errorf("Authorization forwarded = %v, want %v", ok, tt.auth)
+			}
+			if next.Method == "GET" && next.Body != nil {
+				t.Errorf("GET redirect kept body %q", next.Body)
+			}
+		})
+	}
+}
+
+func TestDoTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure " + r.URL.Path))
+	}))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	original := TLSConfig
+	defer func() { TLSConfig = original }()
+	TLSConfig = &tls.Config{RootCAs: roots}
+
+	host := server.Listener.Addr().String()
+	res, err := Do(HttpRequest{Scheme: "https", Method: "GET", Uri: "/greet", Version: "HTTP/1.1", Host: host, Connection: "close"})
+	if err != nil {
+		t.Fatalf("Do() error = %v", err)
+	}
+	if res.StatusCode != "200" || string(res.Data) != "secure /greet" {
+		t.Errorf("got %s %q", res.StatusCode, res.Data)
+	}
+
+	TLSConfig = &tls.Config{}
+	if _, err := Do(HttpRequest{Scheme: "https", Method: "GET", Uri: "/", Version: "HTTP/1.1", Host: host}); err == nil {
+		t.Error("Do() trusted an unknown certificate authority")
+	}
+}
+
+func TestEncodingOffered(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		encoding       string
+		want           bool
+	}{
+		{"gzip, br", "br", true},
+		{"GZIP", "gzip", true},
+		{"*", "zstd", true},
+		{"gzip", "br", false},
+		{"none", "gzip", false},
+		{"gzip;q=0.5, deflate", "deflate", true},
+		{"gzip;q=0", "gzip", false},
+		{"gzip; q=0.000", "gzip", false},
+		{"*, gzip;q=0", "gzip", false},
+		{"*;q=0, br", "gzip", false},
+		{"*;q=0, br", "br", true},
+		{"gzip;q=bogus", "gzip", false},
+	}
+
+	for _, tt := range tests {
+		if got := encodingOffered(tt.acceptEncoding, tt.encoding); got != tt.want {
+			t.Errorf("encodingOffered(%q, %q) = %v, want %v", tt.acceptEncoding, tt.encoding, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	body := bytes.Repeat([]byte("Halo, dunia! "), 20)
+
+	tests := []struct {
+		encoding string
+		data     []byte
+	}{
+		{"identity", body},
+		{"none", body},
+		{"gzip", gzipBytes(t, body)},
+		{"deflate", deflateBytes(t, body)},
+		{"zstd", zstdBytes(t, body)},
+		{"br", brotliBytes(t, body)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			got, err := decodeBody(tt.encoding, tt.data)
+			if err != nil {
+				t.Fatalf("decodeBody() error = %v", err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("decodeBody() = %q, want %q", got, body)
+			}
+		})
+	}
+
+	if _, err := decodeBody("compress", body); err == nil {
+		t.Error("decodeBody(compress) succeeded, want an error")
+	}
+}
+
+func TestFetch(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		response string
+		status   string
+		data     string
+	}{
+		{
+			name:     "content-length",
+			method:   "GET",
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			status:   "200",
+			data:     "hello",
+		},
+		{
+			name:     "chunked",
+			method:   "GET",
+			response: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			status:   "200",
+			data:     "hello",
+		},
+		{
+			name:     "no content",
+			method:   "GET",
+			response: "HTTP/1.1 204 No Content\r\n\r\n",
+			status:   "204",
+		},
+		{
+			name:     "head ignores content-length",
+			method:   "HEAD",
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n",
+			status:   "200",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			go serveOnce(serverConn, tt.response, nil)
+
+			res := Fetch(HttpRequest{Method: tt.method, Uri: "/", Version: "HTTP/1.1", Host: "example"}, clientConn)
+			if res.StatusCode != tt.status {
+				t.Errorf("StatusCode = %q, want %q", res.StatusCode, tt.status)
+			}
+			if string(res.Data) != tt.data {
+				t.Errorf("Data = %q, want %q", res.Data, tt.data)
+			}
+		})
+	}
+}
+
+func TestReadBodyFlag(t *testing.T) {
+	binary := make([]byte, 3*256)
+	for i := range binary {
+		binary[i] = byte(i)
+	}
+	path := filepath.Join(t.TempDir(), "body.bin")
+	if err := os.WriteFile(path, binary, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := readBodyFlag("@" + path)
+	if err != nil || !bytes.Equal(body, binary) {
+		t.Fatalf("readBodyFlag(@file) = %d bytes, %v; want the file's %d bytes", len(body), err, len(binary))
+	}
+	if body, err := readBodyFlag("hello"); err != nil || string(body) != "hello" {
+		t.Errorf("readBodyFlag(inline) = %q, %v", body, err)
+	}
+	if _, err := readBodyFlag("@" + filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("readBodyFlag(@missing) returned no error")
+	}
+
+	// The body must reach the server byte for byte, CR, LF and NUL included.
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		defer serverConn.Close()
+		reader := bufio.NewReader(serverConn)
+		length := 0
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if line == "\r\n" {
+				break
+			}
+			if value, ok := strings.CutPrefix(line, "Content-Length: "); ok {
+				length, _ = strconv.Atoi(strings.TrimSpace(value))
+			}
+		}
+		got := make([]byte, length)
+		io.ReadFull(reader, got)
+		received <- got
+		serverConn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: " + strconv.Itoa(len(got)) + "\r\n\r\n"))
+		serverConn.Write(got)
+	}()
+
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	res := Fetch(HttpRequest{Method: "POST", Uri: "/echo", Version: "HTTP/1.1", Host: "example", ContentType: "application/octet-stream", Body: body}, clientConn)
+	if got := <-received; !bytes.Equal(got, binary) {
+		t.Errorf("server received %d bytes, want the file's %d bytes", len(got), len(binary))
+	}
+	if !bytes.Equal(res.Data, binary) {
+		t.Errorf("echoed %d bytes, want the file's %d bytes", len(res.Data), len(binary))
+	}
+}
+
+func TestSetCookieLines(t *testing.T) {
+	raw := "HTTP/1.1 200 OK\r\n" +
+		"Set-Cookie: a=1\r\n" +
+		"Content-Length: 0\r\n" +
+		"Set-Cookie: b=2; Path=/\r\n" +
+		"Set-Cookie: c=3; HttpOnly\r\n" +
+		"\r\n"
+
+	want := []string{"a=1", "b=2; Path=/", "c=3; HttpOnly"}
+	if got := ResponseDecoder([]byte(raw)).Headers.Values("Set-Cookie"); !slices.Equal(got, want) {
+		t.Errorf("Set-Cookie values = %q, want %q", got, want)
+	}
+}
+
+func TestPrintHeaders(t *testing.T) {
+	res := ResponseDecoder([]byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nX-Custom: hello\r\nVary: Accept\r\nContent-Length: 0\r\n\r\n"))
+
+	var buf bytes.Buffer
+	printHeaders(&buf, res.Headers)
+
+	want := "< Content-Type: text/plain\n" +
+		"< X-Custom: hello\n" +
+		"< Vary: Accept\n" +
+		"< Content-Length: 0\n"
+	if buf.String() != want {
+		t.Errorf("printHeaders() =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestResponseDecoder(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		status   string
+		reason   string
+		encoding string
+		headers  HttpHeaders
+		data     string
+	}{
+		{
+			name:   "content-length",
+			raw:    "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello",
+			status: "200",
+			reason: "OK",
+			headers: HttpHeaders{
+				{Name: "Content-Type", Value: "text/plain"},
+				{Name: "Content-Length", Value: "5"},
+			},
+			data: "hello",
+		},
+		{
+			name:     "chunked",
+			raw:      "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nhel\r\n2;ext=1\r\nlo\r\n0\r\nX-Trailer: 1\r\n\r\n",
+			status:   "200",
+			reason:   "OK",
+			encoding: "gzip",
+			headers: HttpHeaders{
+				{Name: "Content-Encoding", Value: "gzip"},
+				{Name: "Transfer-Encoding", Value: "chunked"},
+			},
+			data: "hello",
+		},
+		{
+			name:   "reason phrase with spaces",
+			raw:    "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n",
+			status: "404",
+			reason: "Not Found",
+			headers: HttpHeaders{
+				{Name: "Content-Length", Value: "0"},
+			},
+		},
+		{
+			name:   "arbitrary headers",
+			raw:    "HTTP/1.1 301 Moved Permanently\r\nLocation: /new\r\nETag: \"v1\"\r\nVary: Accept\r\nX-Custom: a: b\r\nContent-Length: 0\r\n\r\n",
+			status: "301",
+			reason: "Moved Permanently",
+			headers: HttpHeaders{
+				{Name: "Location", Value: "/new"},
+				{Name: "ETag", Value: `"v1"`},
+				{Name: "Vary", Value: "Accept"},
+				{Name: "X-Custom", Value: "a: b"},
+				{Name: "Content-Length", Value: "0"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := ResponseDecoder([]byte(tt.raw))
+			if res.StatusCode != tt.status || res.ReasonPhrase != tt.reason {
+				t.Errorf("status = %q %q, want %q %q", res.StatusCode, res.ReasonPhrase, tt.status, tt.reason)
+			}
+			if res.ContentEncoding != tt.encoding {
+				t.Errorf("ContentEncoding = %q, want %q", res.ContentEncoding, tt.encoding)
+			}
+			if !slices.Equal(res.Headers, tt.headers) {
+				t.Errorf("Headers = %q, want %q", res.Headers, tt.headers)
+			}
+			if string(res.Data) != tt.data {
+				t.Errorf("Data = %q, want %q", res.Data, tt.data)
+			}
+		})
+	}
+}
+
+func TestFormFlagsSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"name=Budi", false},
+		{"name=", false},
+		{"name", true},
+		{"=Budi", true},
+	}
+
+	for _, tt := range tests {
+		if err := (formFlags{}).Set(tt.value); (err != nil) != tt.wantErr {
+			t.Errorf("formFlags.Set(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+		}
+	}
+
+	files := fileFlags{}
+	if err := files.Set("upload=@/tmp/a.txt"); err != nil || files["upload"] != "/tmp/a.txt" {
+		t.Errorf("fileFlags.Set(upload=@/tmp/a.txt) = %v, files = %v", err, files)
+	}
+	for _, value := range []string{"upload=/tmp/a.txt", "=@/tmp/a.txt", "upload=@"} {
+		if err := (fileFlags{}).Set(value); err == nil {
+			t.Errorf("fileFlags.Set(%q) returned no error", value)
+		}
+	}
+}
+
+func TestFormBody(t *testing.T) {
+	body, contentType, err := formBody(url.Values{"name": {"Budi Santoso"}}, nil)
+	if err != nil || string(body) != "name=Budi+Santoso" || contentType != "application/x-www-form-urlencoded" {
+		t.Errorf("urlencoded formBody() = %q, %q, %v", body, contentType, err)
+	}
+
+	content := []byte("hello\r\n\x00\xff")
+	path := filepath.Join(t.TempDir(), "hello.bin")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	body, contentType, err = formBody(url.Values{"note": {"hi"}}, fileFlags{"file": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A stand-in for the server's POST /upload: it parses the multipart
+	// body the way the server does and reports the file it found.
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	received := make(chan map[string][]byte, 1)
+	go func() {
+		defer serverConn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(serverConn))
+		if err != nil {
+			received <- nil
+			return
+		}
+		parts := map[string][]byte{}
+		if err := req.ParseMultipartForm(1 << 20); err == nil {
+			parts["note"] = []byte(req.FormValue("note"))
+			if file, header, err := req.FormFile("file"); err == nil {
+				data, _ := io.ReadAll(file)
+				parts[header.Filename] = data
+			}
+		}
+		received <- parts
+		response := `{"name":"hello.bin","size":` + strconv.Itoa(len(parts["hello.bin"])) + "}"
+		serverConn.Write([]byte("HTTP/1.1 201 Created\r\nContent-Type: application/json\r\nContent-Length: " + strconv.Itoa(len(response)) + "\r\n\r\n" + response))
+	}()
+
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	res := Fetch(HttpRequest{Method: "POST", Uri: "/upload", Version: "HTTP/1.1", Host: "example", ContentType: contentType, Body: body}, clientConn)
+	parts := <-received
+	if string(parts["note"]) != "hi" || !bytes.Equal(parts["hello.bin"], content) {
+		t.Errorf("server received parts %q, want note=hi and hello.bin = %q", parts, content)
+	}
+	if res.StatusCode != "201" || string(res.Data) != `{"name":"hello.bin","size":9}` {
+		t.Errorf("response = %s %s", res.StatusCode, res.Data)
+	}
+}
+
+func TestResponseDecoderKeepsCRLFBytes(t *testing.T) {
+	// Find a payload whose gzip stream itself contains CRLF, so a decoder
+	// that splits the body on line breaks would corrupt it.
+	var payload, compressed []byte
+	for i := 0; !bytes.Contains(compressed, []byte("\r\n")); i++ {
+		payload = []byte(strings.Repeat("{\"line\": "+strconv.Itoa(i)+"}\r\n", 3) + "\r\n\r\nend")
+		compressed = gzipBytes(t, payload)
+	}
+
+	raw := "HTTP/1.1 200 OK\r\nContent-Encoding: gzip\r\nContent-Length: " + strconv.Itoa(len(compressed)) + "\r\n\r\n" + string(compressed)
+	res := ResponseDecoder([]byte(raw))
+	if !bytes.Equal(res.Data, compressed) {
+		t.Fatalf("Data differs from the gzip stream sent")
+	}
+
+	decoded, err := decodeBody(res.ContentEncoding, res.Data)
+	if err != nil || !bytes.Equal(decoded, payload) {
+		t.Errorf("decodeBody() = %q, %v; want %q", decoded, err, payload)
+	}
+}
+
+func TestPrintDryRun(t *testing.T) {
+	defer func(dial func(string, string) (net.Conn, error)) { Dialer = dial }(Dialer)
+	Dialer = func(network string, address string) (net.Conn, error) {
+		t.Errorf("dry run dialed %s %s", network, address)
+		return nil, errors.New("dry run must not dial")
+	}
+
+	req := HttpRequest{Method: "POST", Uri: "/echo", Version: "HTTP/1.1", Host: "localhost:6969", ContentType: "text/plain", Body: []byte("hello")}
+
+	var buf bytes.Buffer
+	printDryRun(&buf, req)
+
+	if want := "\n" + string(RequestEncoder(req)); buf.String() != want {
+		t.Errorf("printDryRun() = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestResponseDecoderServerFraming(t *testing.T) {
+	// The server sends small bodies with Content-Length and splits large
+	// ones into BUFFER_SIZE chunks.
+	small := []byte("hello\r\n")
+	large := bytes.Repeat([]byte("0123456789\r\n"), 1000)
+
+	smallRaw := "HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(small)) + "\r\n\r\n" + string(small)
+	if res := ResponseDecoder([]byte(smallRaw)); !bytes.Equal(res.Data, small) {
+		t.Errorf("Content-Length body = %q, want %q", res.Data, small)
+	}
+
+	largeRaw := "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"
+	for data := large; len(data) > 0; {
+		chunk := data[:min(len(data), BUFFER_SIZE)]
+		largeRaw += strconv.FormatInt(int64(len(chunk)), 16) + "\r\n" + string(chunk) + "\r\n"
+		data = data[len(chunk):]
+	}
+	largeRaw += "0\r\n\r\n"
+
+	res := ResponseDecoder([]byte(largeRaw))
+	if !bytes.Equal(res.Data, large) || res.ContentLength != len(large) {
+		t.Errorf("chunked body = %d bytes (ContentLength %d), want %d", len(res.Data), res.ContentLength, len(large))
+	}
+}
+
+func TestPrintParsedBody(t *testing.T) {
+	jsonBody := `{"Student":{"Nama":"Budi","Npm":"1"},"Greeter":"Ani"}`
+	xmlBody := "<GreetResponse><Student><Nama>Budi</Nama><Npm>1</Npm></Student><Greeter>Ani</Greeter></GreetResponse>"
+	parsed := "Parsed: {{Budi 1} Ani}\n"
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"json", "application/json", jsonBody, parsed},
+		{"json with charset", "application/json; charset=utf-8", jsonBody, parsed},
+		{"json in upper case", "Application/JSON", jsonBody, parsed},
+		{"xml with parameters", "application/xml; charset=iso-8859-1", xmlBody, parsed},
+		{"json-seq lookalike", "application/json-seq", jsonBody, ""},
+		{"jsonp lookalike", "application/jsonp", jsonBody, ""},
+		{"xml lookalike", "application/xml-dtd", xmlBody, ""},
+		{"malformed content type", "application/json;;", jsonBody, ""},
+		{"plain text", "text/plain", jsonBody, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			printParsedBody(&buf, tt.contentType, []byte(tt.body))
+			if buf.String() != tt.want {
+				t.Errorf("printParsedBody(%q) = %q, want %q", tt.contentType, buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchNDJSONStream(t *testing.T) {
+	lines := []string{`{"seq":1}`, `{"seq":2}`, `{"seq":3}`}
+	raw := "HTTP/1.1 200 OK\r\nContent-Type: application/x-ndjson\r\nTransfer-Encoding: chunked\r\n\r\n"
+	for _, line := range lines {
+		raw += fmt.Sprintf("%x\r\n%s\n\r\n", len(line)+1, line)
+	}
+	raw += "0\r\n\r\n"
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go serveOnce(serverConn, raw, nil)
+
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	res := Fetch(HttpRequest{Method: "GET", Uri: "/stream", Version: "HTTP/1.1", Host: "example"}, clientConn)
+
+	var buf bytes.Buffer
+	printParsedBody(&buf, res.ContentType, res.Data)
+	want := "Parsed line 1: map[seq:1]\nParsed line 2: map[seq:2]\nParsed line 3: map[seq:3]\n"
+	if buf.String() != want {
+		t.Errorf("printParsedBody() = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestHeaderFlagsSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"X-Trace: 1", false},
+		{"X-Trace:", false},
+		{"X-Trace", true},
+		{": value", true},
+		{"Bad Name: value", true},
+		{"X-Trace: a\r\nSet-Cookie: evil=1", true},
+	}
+
+	for _, tt := range tests {
+		if err := (headerFlags{}).Set(tt.value); (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestFetchChunkedOverridesContentLength(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go serveOnce(serverConn, "HTTP/1.1 200 OK\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", nil)
+
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	res := Fetch(HttpRequest{Method: "GET", Uri: "/", Version: "HTTP/1.1", Host: "example"}, clientConn)
+	if res.StatusCode != "200" || string(res.Data) != "hello" {
+		t.Errorf("Fetch() = %s %q, want 200 with the chunked body", res.StatusCode, res.Data)
+	}
+}
+
+func TestFetchWithFinalEOF(t *testing.T) {
+	large := strings.Repeat("a", 3*BUFFER_SIZE)
+	for _, body := range []string{"hello", large} {
+		conn := &dataEOFConn{data: []byte("HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body)}
+		res := Fetch(HttpRequest{Method: "GET", Uri: "/", Version: "HTTP/1.1", Host: "example"}, conn)
+		if res.StatusCode != "200" || string(res.Data) != body {
+			t.Errorf("Fetch() = %s with %d bytes, want 200 with %d bytes", res.StatusCode, len(res.Data), len(body))
+		}
+		if !strings.HasPrefix(conn.written.String(), "GET / HTTP/1.1\r\n") {
+			t.Errorf("request written = %q", conn.written.String())
+		}
+	}
+}
+
+// serveOnce reads one request head from connection and answers with
+// response, leaving the connection open so Fetch has to stop on framing
+// alone. An empty response closes the connection instead.
+func serveOnce(connection net.Conn, response string, onRequest func([]byte)) {
+	var request []byte
+	buffer := make([]byte, BUFFER_SIZE)
+	for !bytes.Contains(request, []byte("\r\n\r\n")) {
+		n, err := connection.Read(buffer)
+		request = append(request, buffer[:n]...)
+		if err != nil {
+			return
+		}
+	}
+	if onRequest != nil {
+		onRequest(request)
+	}
+	if response == "" {
+		connection.Close()
+		return
+	}
+	connection.Write([]byte(response))
+	io.Copy(io.Discard, connection)
+}
+
+// dataEOFConn hands out its data in reads of at most len(p) bytes and
+// returns io.EOF together with the last of them, as net.Conn allows.
+type dataEOFConn struct {
+	net.Conn
+	data    []byte
+	written bytes.Buffer
+}
+
+func (c *dataEOFConn) Read(p []byte) (int, error) {
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	if len(c.data) == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *dataEOFConn) Write(p []byte) (int, error)        { return c.written.Write(p) }
+func (c *dataEOFConn) Close() error                       { return nil }
+func (c *dataEOFConn) RemoteAddr() net.Addr               { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c *dataEOFConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dataEOFConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dataEOFConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func deflateBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zstdBytes compresses data the way the server's compressZstd does.
+// brotliBytes compresses data the way the server's compressBrotli does.
+func brotliBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := brotli.NewWriter(&buf)
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(data)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
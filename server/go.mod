@@ -1,3 +1,8 @@
 module compnetcsui/a03/server
 
 go 1.25.1
+
+require (
+	github.com/andybalholm/brotli v1.2.5
+	github.com/klauspost/compress v1.20.1
+)
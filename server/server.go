@@ -4,12 +4,35 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime/multipart"
 	"net"
+	"net/http"
+	"net/textproto"
 	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 const (
@@ -19,244 +42,2447 @@ const (
 	BUFFER_SIZE  = 2048
 	STUDENT_NAME = "Muhammad Raihan Maulana"
 	STUDENT_NPM  = "2306216636"
+	SERVER_NAME  = "jarkom-A3/1.0"
+
+	MAX_HEADER_BYTES = 8 * 1024
+	MAX_HEADER_COUNT = 100
+	MAX_BODY_BYTES   = 1024 * 1024
+
+	MAX_REQUEST_ID_LENGTH = 128
+
+	KEEP_ALIVE_TIMEOUT = 5 * time.Second
+	READ_TIMEOUT       = 30 * time.Second
+	SHUTDOWN_TIMEOUT   = 10 * time.Second
+
+	GZIP_TEST_DEFAULT_SIZE = 64 * 1024
+	GZIP_TEST_MAX_SIZE     = 4 * 1024 * 1024
+
+	STREAM_DEFAULT_COUNT = 3
+	STREAM_MAX_COUNT     = 100
+
+	SLOW_STREAM_DEFAULT_COUNT = 10
+	SLOW_STREAM_DEFAULT_DELAY = 200 * time.Millisecond
+	SLOW_STREAM_MAX_DURATION  = 10 * time.Second
+
+	CHUNKED_THRESHOLD = 64 * 1024
 )
 
-type Student struct {
-	Nama string
-	Npm  string
+type Student struct {
+	Nama string
+	Npm  string
+}
+
+type GreetResponse struct {
+	Student Student
+	Greeter string
+}
+
+type HttpRequest struct {
+	Method           string
+	Uri              string
+	Version          string
+	Host             string
+	Accept           string
+	AcceptEncoding   string
+	AcceptCharset    string
+	Expect           string
+	Authorization    string
+	Connection       string
+	ContentType      string
+	ContentLength    int
+	TransferEncoding string
+	Cookies          map[string]string
+	Headers          HttpHeaders
+	Params           map[string]string
+	RemoteAddr       string
+	Received         time.Time
+	RawHeaders       []byte
+	DecodeError      HTTPError
+	Body             []byte
+}
+
+type HttpHeaders map[string][]string
+
+func (h HttpHeaders) Get(name string) string {
+	if values := h[textproto.CanonicalMIMEHeaderKey(name)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (h HttpHeaders) Values(name string) []string {
+	return h[textproto.CanonicalMIMEHeaderKey(name)]
+}
+
+type HttpResponse struct {
+	Version         string
+	StatusCode      string
+	ContentType     string
+	ContentEncoding string
+	ContentLength   int
+	Connection      string
+	Chunked         bool
+	Chunks          [][]byte
+	ChunkInterval   time.Duration
+	Headers         map[string]string
+	SetCookies      []string
+	Data            []byte
+}
+
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	var pairs []string
+	for name, value := range h {
+		pairs = append(pairs, name+": "+value)
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func (h headerFlags) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("header %q must have the form \"Name: Value\"", value)
+	}
+
+	name := strings.TrimSpace(parts[0])
+	if !isToken(name) {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if reservedHeaders[strings.ToLower(name)] {
+		return fmt.Errorf("header %q is set by the server and cannot be injected", name)
+	}
+
+	headerValue := strings.TrimSpace(parts[1])
+	if strings.ContainsAny(headerValue, "\r\n") {
+		return fmt.Errorf("invalid value for header %q", name)
+	}
+
+	h[name] = headerValue
+	return nil
+}
+
+var injectedHeaders = headerFlags{}
+
+// reservedHeaders are written by ResponseEncoder itself, so injecting them
+// would duplicate or contradict the framing it sends.
+var reservedHeaders = map[string]bool{
+	"connection":        true,
+	"content-encoding":  true,
+	"content-length":    true,
+	"content-type":      true,
+	"date":              true,
+	"server":            true,
+	"transfer-encoding": true,
+}
+
+var serverHost = SERVER_HOST
+
+var serverPort = SERVER_PORT
+
+// supportedEncodings is in preference order; the first coding wins a q tie.
+var supportedEncodings = []string{"br", "zstd", "gzip", "deflate"}
+
+// explicitOnlyEncodings are never chosen through "*", only when named.
+var explicitOnlyEncodings = map[string]bool{"zstd": true}
+
+var enabledEncodings = map[string]bool{
+	"br":      true,
+	"gzip":    true,
+	"deflate": true,
+	"zstd":    true,
+}
+
+// defaultAcceptEncoding stands in for a missing Accept-Encoding header.
+// "none" keeps such responses uncompressed.
+var defaultAcceptEncoding = "none"
+
+var minCompressionRatio = 1.0
+
+var supportedCharsets = []string{"utf-8", "iso-8859-1", "us-ascii"}
+
+var strictCharset = false
+
+var strictAccept = false
+
+var compressibleTypes = []string{"text/*", "application/json", "application/xml", "application/yaml"}
+
+var allowHTTP09 = false
+
+var maxHeaderBytes = MAX_HEADER_BYTES
+
+var maxBodyBytes = MAX_BODY_BYTES
+
+var strictFraming = true
+
+var lenientEOFBody = false
+
+var sniffGzipBody = false
+
+var uploadDir = ""
+
+var trustedProxies []*net.IPNet
+
+var keepAliveTimeout = KEEP_ALIVE_TIMEOUT
+
+var maxKeepAlive = 0
+
+var maxConnections = 0
+
+var requestTimeout time.Duration = 0
+
+var readTimeout = READ_TIMEOUT
+
+// keepAliveConns counts idle keep-alive connections: those that have been
+// answered with keep-alive and are waiting for their next request.
+var keepAliveConns atomic.Int64
+
+var activeConns atomic.Int64
+
+var shutdownTimeout = SHUTDOWN_TIMEOUT
+
+var allowedHosts = map[string]bool{}
+
+var adminToken = ""
+
+var jsonEscapeHTML = true
+
+var responseRate = 0
+
+var chunkedThreshold = CHUNKED_THRESHOLD
+
+var timeNow = time.Now
+
+// accessLog receives one line per request; nil leaves logging off.
+var accessLog = struct {
+	sync.Mutex
+	out io.Writer
+}{}
+
+var startTime = time.Now()
+
+var disabledRoutes = struct {
+	sync.RWMutex
+	routes map[string]bool
+}{routes: make(map[string]bool)}
+
+var rootMessage = fmt.Sprintf("Halo, dunia! Aku %s sedang mengerjakan A03", STUDENT_NAME)
+
+var rootHTML = []byte("<html><body><h1>" + rootMessage + "</h1></body></html>")
+
+var rootFromFile = false
+
+type RootResponse struct {
+	Message string
+}
+
+type ServerConfig struct {
+	Host                  string            `json:"host"`
+	Port                  string            `json:"port"`
+	EnabledEncodings      []string          `json:"enabled_encodings"`
+	DefaultAcceptEncoding string            `json:"default_accept_encoding"`
+	CompressibleTypes     []string          `json:"compressible_types"`
+	MinCompressionRatio   float64           `json:"min_compression_ratio"`
+	MaxHeaderBytes        int               `json:"max_header_bytes"`
+	MaxBodyBytes          int               `json:"max_body_bytes"`
+	KeepAliveTimeout      string            `json:"keep_alive_timeout"`
+	ReadTimeout           string            `json:"read_timeout"`
+	RequestTimeout        string            `json:"request_timeout"`
+	ShutdownTimeout       string            `json:"shutdown_timeout"`
+	MaxKeepAlive          int               `json:"max_keepalive"`
+	MaxConnections        int               `json:"max_connections"`
+	ResponseRate          int               `json:"response_rate"`
+	ChunkedThreshold      int               `json:"chunked_threshold"`
+	JSONEscapeHTML        bool              `json:"json_escape_html"`
+	StrictFraming         bool              `json:"strict_framing"`
+	StrictAccept          bool              `json:"strict_accept"`
+	StrictCharset         bool              `json:"strict_charset"`
+	AllowHTTP09           bool              `json:"allow_http09"`
+	LenientEOFBody        bool              `json:"lenient_eof_body"`
+	SniffGzipBody         bool              `json:"sniff_gzip_body"`
+	UploadDir             string            `json:"upload_dir"`
+	AllowedHosts          []string          `json:"allowed_hosts"`
+	TrustedProxies        []string          `json:"trusted_proxies"`
+	InjectedHeaders       map[string]string `json:"injected_headers"`
+}
+
+type StreamEvent struct {
+	Seq     int     `json:"seq"`
+	Student Student `json:"student"`
+	Message string  `json:"message"`
+}
+
+type HealthResponse struct {
+	Status        string `json:"status"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+}
+
+type UploadResponse struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+type RuntimeStats struct {
+	Goroutines        int    `json:"goroutines"`
+	ActiveConnections int64  `json:"active_connections"`
+	KeepAliveConns    int64  `json:"keep_alive_connections"`
+	HeapAllocBytes    uint64 `json:"heap_alloc_bytes"`
+	HeapObjects       uint64 `json:"heap_objects"`
+	TotalAllocBytes   uint64 `json:"total_alloc_bytes"`
+	SysBytes          uint64 `json:"sys_bytes"`
+	NumGC             uint32 `json:"num_gc"`
+}
+
+type HTTPError struct {
+	StatusCode string
+	Message    string
+}
+
+func (e HTTPError) Error() string {
+	if e.Message == "" {
+		return e.StatusCode + " " + reasonPhrase(e.StatusCode)
+	}
+	return e.StatusCode + " " + e.Message
+}
+
+type StatusPage struct {
+	StatusCode string
+	Message    string
+	Path       string
+}
+
+var reasonPhrases = map[string]string{
+	"100": "Continue",
+	"200": "OK",
+	"201": "Created",
+	"204": "No Content",
+	"206": "Partial Content",
+	"301": "Moved Permanently",
+	"302": "Found",
+	"304": "Not Modified",
+	"307": "Temporary Redirect",
+	"308": "Permanent Redirect",
+	"400": "Bad Request",
+	"401": "Unauthorized",
+	"403": "Forbidden",
+	"404": "Not Found",
+	"405": "Method Not Allowed",
+	"406": "Not Acceptable",
+	"408": "Request Timeout",
+	"411": "Length Required",
+	"413": "Content Too Large",
+	"414": "URI Too Long",
+	"415": "Unsupported Media Type",
+	"417": "Expectation Failed",
+	"421": "Misdirected Request",
+	"429": "Too Many Requests",
+	"431": "Request Header Fields Too Large",
+	"500": "Internal Server Error",
+	"501": "Not Implemented",
+	"502": "Bad Gateway",
+	"503": "Service Unavailable",
+	"504": "Gateway Timeout",
+	"505": "HTTP Version Not Supported",
+}
+
+var reasonClasses = map[byte]string{
+	'1': "Informational",
+	'2': "Success",
+	'3': "Redirection",
+	'4': "Client Error",
+	'5': "Server Error",
+}
+
+// statusTemplate is satisfied by both html/template and text/template.
+type statusTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+var statusTemplates = map[string]map[string]statusTemplate{}
+
+var defaultHTMLStatusTemplate = htmltemplate.Must(htmltemplate.New("html").Parse("<html><body><h1>{{.StatusCode}} {{.Message}}</h1></body></html>"))
+
+type StatusBody struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func main() {
+	flag.StringVar(&serverHost, "host", serverHost, "interface address to listen on")
+	flag.StringVar(&serverPort, "port", serverPort, "TCP port to listen on (0 picks a free port)")
+	encodings := flag.String("encodings", strings.Join(supportedEncodings, ","), "comma-separated list of content codings the server may use")
+	flag.StringVar(&defaultAcceptEncoding, "default-accept-encoding", defaultAcceptEncoding, "Accept-Encoding assumed when a request sends none (\"none\" means identity)")
+	flag.Float64Var(&minCompressionRatio, "min-compression-ratio", minCompressionRatio, "send identity unless original/compressed size exceeds this ratio")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", maxHeaderBytes, "maximum size of the request line and headers before 431 is returned")
+	flag.IntVar(&maxBodyBytes, "max-body-bytes", maxBodyBytes, "maximum request body size before 413 is returned")
+	flag.BoolVar(&strictFraming, "strict-framing", strictFraming, "reject requests carrying both Transfer-Encoding and Content-Length instead of ignoring Content-Length")
+	flag.BoolVar(&sniffGzipBody, "sniff-gzip-body", sniffGzipBody, "decompress a request body that starts with the gzip magic bytes even without Content-Encoding")
+	flag.BoolVar(&lenientEOFBody, "lenient-eof-body", lenientEOFBody, "read a POST or PUT body sent without Content-Length or chunked framing until the client closes, up to -max-body-bytes")
+	flag.DurationVar(&keepAliveTimeout, "keep-alive-timeout", keepAliveTimeout, "how long an idle persistent connection is kept open")
+	flag.DurationVar(&readTimeout, "read-timeout", readTimeout, "longest pause between reads once a request has started; 408 once exceeded (0 disables)")
+	flag.DurationVar(&requestTimeout, "request-timeout", requestTimeout, "budget from a request's first byte to its response being written; 503 once exceeded (0 disables)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "how long shutdown waits for open connections before force-closing them")
+	flag.IntVar(&maxKeepAlive, "max-keepalive", maxKeepAlive, "maximum idle keep-alive connections; beyond it responses carry Connection: close (0 disables)")
+	flag.IntVar(&maxConnections, "max-connections", maxConnections, "maximum concurrent connections; beyond it new connections get 503 and are closed (0 disables)")
+	flag.BoolVar(&strictAccept, "strict-accept", strictAccept, "answer 406 when Accept names no producible media type instead of sending JSON")
+	flag.BoolVar(&strictCharset, "strict-charset", strictCharset, "answer 406 when Accept-Charset excludes every supported charset instead of sending utf-8")
+	flag.BoolVar(&allowHTTP09, "http09", allowHTTP09, "answer two-token HTTP/0.9 request lines with a bare body instead of 400")
+	hosts := flag.String("allowed-hosts", "", "comma-separated Host values to accept; others get 421 (empty disables the check)")
+	proxies := flag.String("trusted-proxies", "", "comma-separated CIDRs of proxies whose X-Forwarded-For is honored")
+	flag.StringVar(&adminToken, "admin-token", adminToken, "bearer token required for /admin routes (empty disables them)")
+	flag.BoolVar(&jsonEscapeHTML, "json-escape-html", jsonEscapeHTML, "escape <, > and & in JSON responses (override per request with ?escape_html=)")
+	flag.StringVar(&uploadDir, "upload-dir", uploadDir, "directory POST /upload stores files in (empty disables the route)")
+	rootFile := flag.String("root-file", "", "HTML file served at / instead of the built-in greeting")
+	compressible := flag.String("compressible-types", strings.Join(compressibleTypes, ","), "comma-separated media types (type/* allowed) eligible for compression")
+	flag.IntVar(&responseRate, "response-rate", responseRate, "throttle response writes to this many bytes/sec (0 disables)")
+	flag.IntVar(&chunkedThreshold, "chunked-threshold", chunkedThreshold, "send HTTP/1.1 bodies larger than this many bytes with chunked framing (0 disables)")
+	flag.Var(injectedHeaders, "header", "static \"Name: Value\" header added to every response (repeatable)")
+	logAccesses := flag.Bool("access-log", false, "print one access log line per request to stdout")
+	flag.Func("status-template", "CODE=FILE body template for a status code; .html files serve text/html, .json files application/json (repeatable)", registerStatusTemplateFile)
+	flag.Parse()
+
+	enabled, err := parseEncodingList(*encodings)
+	if err != nil {
+		fmt.Printf("Error parsing -encodings: %v\n", err)
+		return
+	}
+	enabledEncodings = enabled
+
+	compressibleTypes = nil
+	for _, mediaType := range strings.Split(*compressible, ",") {
+		if mediaType = strings.ToLower(strings.TrimSpace(mediaType)); mediaType != "" {
+			compressibleTypes = append(compressibleTypes, mediaType)
+		}
+	}
+
+	if *rootFile != "" {
+		rootFromFile = true
+		rootHTML, err = os.ReadFile(*rootFile)
+		if err != nil {
+			fmt.Printf("Error reading -root-file: %v\n", err)
+			return
+		}
+	}
+
+	if *logAccesses {
+		accessLog.out = os.Stdout
+	}
+
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			allowedHosts[strings.ToLower(stripPort(host))] = true
+		}
+	}
+
+	for _, cidr := range strings.Split(*proxies, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			fmt.Printf("Error parsing -trusted-proxies: %v\n", err)
+			return
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+
+	listener, err := net.Listen(SERVER_TYPE, net.JoinHostPort(serverHost, serverPort))
+	if err != nil {
+		fmt.Printf("Error starting server: %v\n", err)
+		return
+	}
+	defer listener.Close()
+
+	// Report the bound address, which differs from the flags for port 0.
+	serverHost, serverPort, _ = net.SplitHostPort(listener.Addr().String())
+	fmt.Printf("Server listening on %s\n", listener.Addr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	Serve(ctx, listener)
+}
+
+// Serve accepts connections until ctx is cancelled, then closes the
+// listener and waits up to shutdownTimeout for open connections to finish
+// before closing whatever is still open.
+func Serve(ctx context.Context, listener net.Listener) {
+	var connections sync.WaitGroup
+	open := struct {
+		sync.Mutex
+		conns map[net.Conn]bool
+	}{conns: make(map[net.Conn]bool)}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			fmt.Printf("Error accepting connection: %v\n", err)
+			continue
+		}
+
+		open.Lock()
+		open.conns[connection] = true
+		open.Unlock()
+
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			defer func() {
+				open.Lock()
+				delete(open.conns, connection)
+				open.Unlock()
+			}()
+			HandleConnection(ctx, connection)
+		}()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		connections.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		fmt.Println("Server stopped: all connections drained cleanly")
+	case <-time.After(shutdownTimeout):
+		open.Lock()
+		for connection := range open.conns {
+			connection.Close()
+		}
+		fmt.Printf("Server stopped: forced %d connections closed after the %v shutdown timeout\n", len(open.conns), shutdownTimeout)
+		open.Unlock()
+	}
+}
+
+// HandleConnection serves requests on connection until it closes. Once ctx
+// is done the connection is closed after its in-flight response, and an
+// idle keep-alive wait is cut short.
+func HandleConnection(ctx context.Context, connection net.Conn) {
+	defer connection.Close()
+
+	if activeConns.Add(1) > int64(maxConnections) && maxConnections > 0 {
+		activeConns.Add(-1)
+		rejectConnection(connection)
+		return
+	}
+	defer activeConns.Add(-1)
+
+	idle := false
+	defer func() {
+		if idle {
+			keepAliveConns.Add(-1)
+		}
+	}()
+
+	served := 0
+	defer func() {
+		logConnectionClosed(connection.RemoteAddr(), served)
+	}()
+
+	var pending []byte
+	for {
+		// Reaps idle keep-alive connections: no new request within
+		// keepAliveTimeout of the last response closes the connection.
+		connection.SetReadDeadline(time.Now().Add(keepAliveTimeout))
+
+		var err error
+		if len(pending) == 0 {
+			pending, err = awaitRequest(ctx, connection)
+		}
+		if idle {
+			keepAliveConns.Add(-1)
+			idle = false
+		}
+
+		var httpReq HttpRequest
+		var rest []byte
+		if err == nil {
+			httpReq, rest, err = readRequest(connection, pending)
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) {
+				fmt.Printf("Error reading request: %v\n", err)
+			}
+			return
+		}
+		pending = rest
+		httpReq.RemoteAddr = clientAddr(httpReq, connection.RemoteAddr())
+
+		httpRes := serveWithTimeout(httpReq)
+		if ctx.Err() != nil {
+			httpRes.Connection = "close"
+		}
+		if httpRes.Connection == "keep-alive" {
+			if idle = reserveKeepAlive(); !idle {
+				httpRes.Connection = "close"
+			}
+		}
+
+		if deadline := httpReq.Received.Add(requestTimeout); requestTimeout > 0 && time.Now().Before(deadline) {
+			connection.SetWriteDeadline(deadline)
+		} else {
+			connection.SetWriteDeadline(time.Time{})
+		}
+
+		if httpRes.Chunked && httpRes.ChunkInterval > 0 {
+			writePacedChunks(connection, httpRes)
+		} else {
+			writeResponse(connection, ResponseEncoder(httpRes))
+		}
+		served++
+		logAccess(httpReq, httpRes, served)
+
+		if httpRes.Connection != "keep-alive" || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// logAccess records the request line, status, the body sizes read and
+// written, and which request this was on its connection, so large uploads
+// show up next to large responses and keep-alive reuse is visible.
+func logAccess(req HttpRequest, res HttpResponse, connRequest int) {
+	accessLog.Lock()
+	defer accessLog.Unlock()
+
+	if accessLog.out == nil {
+		return
+	}
+
+	fmt.Fprintf(accessLog.out, "%s \"%s %s %s\" %s request_bytes=%d response_bytes=%d conn_request=%d\n",
+		req.RemoteAddr, req.Method, req.Uri, req.Version, res.StatusCode, len(req.Body), len(res.Data), connRequest)
+}
+
+func logConnectionClosed(peer net.Addr, served int) {
+	accessLog.Lock()
+	defer accessLog.Unlock()
+
+	if accessLog.out == nil {
+		return
+	}
+
+	fmt.Fprintf(accessLog.out, "%s connection closed after %d requests\n", peer, served)
+}
+
+// serveWithTimeout gives up on a handler still running at the request
+// deadline and answers 503; the handler finishes in the background.
+func serveWithTimeout(req HttpRequest) HttpResponse {
+	if requestTimeout <= 0 || req.DecodeError.StatusCode != "" {
+		return ServeRequest(req)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), req.Received.Add(requestTimeout))
+	defer cancel()
+
+	done := make(chan HttpResponse, 1)
+	go func() {
+		done <- ServeRequest(req)
+	}()
+
+	select {
+	case res := <-done:
+		return res
+	case <-ctx.Done():
+		return errorResponse(req, HTTPError{StatusCode: "503", Message: "request exceeded the request timeout"})
+	}
+}
+
+func clientAddr(req HttpRequest, peer net.Addr) string {
+	host, _, err := net.SplitHostPort(peer.String())
+	if err != nil {
+		host = peer.String()
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	// Each proxy appends the peer it saw, so walk right to left past our own
+	// proxies; the first untrusted hop is the client they vouch for.
+	hops := strings.Split(strings.Join(req.Headers.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		host = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	for _, network := range trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// awaitRequest waits for the next request to start arriving and returns
+// its first bytes; until then the connection counts as idle.
+func awaitRequest(ctx context.Context, connection net.Conn) ([]byte, error) {
+	// Shutdown expires the read deadline so an idle connection stops
+	// waiting instead of holding Serve open until keepAliveTimeout.
+	stop := context.AfterFunc(ctx, func() {
+		connection.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	buffer := make([]byte, BUFFER_SIZE)
+	n, err := connection.Read(buffer)
+	if n > 0 {
+		return buffer[:n], nil
+	}
+	return nil, err
+}
+
+// rejectConnection answers a connection over the -max-connections cap
+// without reading from it.
+func rejectConnection(connection net.Conn) {
+	response := errorResponse(HttpRequest{Version: "HTTP/1.1"}, HTTPError{StatusCode: "503", Message: "too many open connections"})
+	response.Connection = "close"
+	connection.SetWriteDeadline(time.Now().Add(keepAliveTimeout))
+	connection.Write(ResponseEncoder(response))
+}
+
+// isRequestID reports whether an X-Request-Id is safe to echo back: a
+// short run of visible ASCII.
+func isRequestID(id string) bool {
+	if len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func reserveKeepAlive() bool {
+	if keepAliveConns.Add(1) > int64(maxKeepAlive) && maxKeepAlive > 0 {
+		keepAliveConns.Add(-1)
+		return false
+	}
+	return true
+}
+
+func wantsKeepAlive(req HttpRequest) bool {
+	connectionOptions := strings.ToLower(req.Connection)
+
+	switch req.Version {
+	case "HTTP/1.1":
+		return !strings.Contains(connectionOptions, "close")
+	case "HTTP/1.0":
+		return strings.Contains(connectionOptions, "keep-alive")
+	default:
+		return false
+	}
+}
+
+func readRequest(connection net.Conn, pending []byte) (HttpRequest, []byte, error) {
+	buffer := make([]byte, BUFFER_SIZE)
+	requestData := append(make([]byte, 0, BUFFER_SIZE), pending...)
+
+	// The request timeout runs from the first byte, not from when the
+	// connection started waiting for it.
+	var received time.Time
+	markReceived := func() {
+		if received.IsZero() && len(requestData) > 0 {
+			received = time.Now()
+		}
+	}
+	markReceived()
+	timedOut := false
+
+	headerEnd, bodyStart := headerBoundary(requestData)
+
+	for headerEnd == -1 && len(requestData) <= maxHeaderBytes {
+		// Read may return the final bytes together with an error, so keep
+		// them before looking at err.
+		n, err := readMore(connection, buffer, received)
+		requestData = append(requestData, buffer[:n]...)
+		markReceived()
+		headerEnd, bodyStart = headerBoundary(requestData)
+
+		if err != nil {
+			timedOut = errors.Is(err, os.ErrDeadlineExceeded)
+			break
+		}
+	}
+
+	if len(requestData) == 0 {
+		return HttpRequest{}, nil, io.EOF
+	}
+
+	if headerEnd == -1 || headerEnd > maxHeaderBytes {
+		req := RequestDecoder(requestData)
+		req.RawHeaders = requestData
+		req.Received = received
+		if len(requestData) > maxHeaderBytes {
+			req.DecodeError = HTTPError{StatusCode: "431", Message: "request header block is too large"}
+		} else if timedOut {
+			req.DecodeError = timeoutError(received)
+		} else {
+			req.DecodeError = HTTPError{StatusCode: "400", Message: "incomplete request header block"}
+		}
+		return req, nil, nil
+	}
+
+	req := RequestDecoder(requestData[:bodyStart])
+	req.RawHeaders = requestData[:headerEnd]
+	req.Received = received
+	if isChunked(req) && req.DecodeError.StatusCode == "" {
+		return readChunkedBody(connection, req, requestData, bodyStart)
+	}
+	if lenientEOFBody && bodyRunsToEOF(req) {
+		return readBodyUntilEOF(connection, req, requestData, bodyStart)
+	}
+	if req.ContentLength > maxBodyBytes {
+		req.DecodeError = HTTPError{StatusCode: "413", Message: "request body is too large"}
+		return req, nil, nil
+	}
+
+	// Size the buffer for the whole body up front; the cap check above
+	// bounds the allocation.
+	if bodyEnd := bodyStart + req.ContentLength; bodyEnd > cap(requestData) {
+		requestData = append(make([]byte, 0, bodyEnd), requestData...)
+	}
+
+	if len(requestData)-bodyStart < req.ContentLength && expectsContinue(req) {
+		writeContinue(connection, received)
+	}
+
+	for len(requestData)-bodyStart < req.ContentLength {
+		n, err := readMore(connection, buffer, received)
+		requestData = append(requestData, buffer[:n]...)
+
+		if err != nil {
+			timedOut = errors.Is(err, os.ErrDeadlineExceeded)
+			break
+		}
+	}
+
+	if len(requestData)-bodyStart < req.ContentLength && timedOut {
+		req.DecodeError = timeoutError(received)
+		return req, nil, nil
+	}
+
+	if len(requestData)-bodyStart < req.ContentLength {
+		req.DecodeError = HTTPError{StatusCode: "400", Message: "request body is shorter than Content-Length"}
+		return req, nil, nil
+	}
+
+	bodyEnd := bodyStart + req.ContentLength
+	req.Body = requestData[bodyStart:bodyEnd]
+	return req, requestData[bodyEnd:], nil
+}
+
+func readChunkedBody(connection net.Conn, req HttpRequest, requestData []byte, bodyStart int) (HttpRequest, []byte, error) {
+	buffer := make([]byte, BUFFER_SIZE)
+	var decoder chunkDecoder
+	var readErr error
+	continued := !expectsContinue(req)
+
+	for {
+		done, err := decoder.advance(requestData[bodyStart:])
+		if done {
+			req.Body = decoder.body
+			return req, requestData[bodyStart+decoder.offset:], nil
+		}
+		if errors.Is(err, errBodyTooLarge) {
+			req.DecodeError = HTTPError{StatusCode: "413", Message: "request body is too large"}
+			return req, nil, nil
+		}
+		if err != nil {
+			req.DecodeError = HTTPError{StatusCode: "400", Message: err.Error()}
+			return req, nil, nil
+		}
+
+		if readErr != nil {
+			req.DecodeError = HTTPError{StatusCode: "400", Message: "incomplete chunked request body"}
+			if errors.Is(readErr, os.ErrDeadlineExceeded) {
+				req.DecodeError = timeoutError(req.Received)
+			}
+			return req, nil, nil
+		}
+
+		if !continued {
+			writeContinue(connection, req.Received)
+			continued = true
+		}
+
+		var n int
+		n, readErr = readMore(connection, buffer, req.Received)
+		requestData = append(requestData, buffer[:n]...)
+	}
+}
+
+// bodyRunsToEOF reports whether req is a POST or PUT with no framing at
+// all. HTTP/1.1 gives such a request an empty body (RFC 9112 section 6.3),
+// but some clients send one anyway and then close their side.
+func bodyRunsToEOF(req HttpRequest) bool {
+	if req.DecodeError.StatusCode != "" || req.TransferEncoding != "" || len(req.Headers.Values("Content-Length")) > 0 {
+		return false
+	}
+	return req.Method == "POST" || req.Method == "PUT"
+}
+
+// readBodyUntilEOF takes everything up to EOF as the body. The connection
+// cannot carry another request afterwards, so the response closes it.
+func readBodyUntilEOF(connection net.Conn, req HttpRequest, requestData []byte, bodyStart int) (HttpRequest, []byte, error) {
+	buffer := make([]byte, BUFFER_SIZE)
+	for len(requestData)-bodyStart <= maxBodyBytes {
+		n, err := readMore(connection, buffer, req.Received)
+		requestData = append(requestData, buffer[:n]...)
+
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			req.DecodeError = timeoutError(req.Received)
+			return req, nil, nil
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if len(requestData)-bodyStart > maxBodyBytes {
+		req.DecodeError = HTTPError{StatusCode: "413", Message: "request body is too large"}
+		return req, nil, nil
+	}
+
+	req.Body = requestData[bodyStart:]
+	req.ContentLength = len(req.Body)
+	req.Connection = "close"
+	return req, nil, nil
+}
+
+// readMore reads the next part of a request. Before its first byte the
+// connection's keep-alive idle deadline applies; once it has started, each
+// read gets readTimeout, bounded by the request timeout, so a slow upload
+// keeps going as long as bytes keep arriving.
+func readMore(connection net.Conn, buffer []byte, received time.Time) (int, error) {
+	if !received.IsZero() {
+		var deadline time.Time
+		if readTimeout > 0 {
+			deadline = time.Now().Add(readTimeout)
+		}
+		if requestDeadline := received.Add(requestTimeout); requestTimeout > 0 && (deadline.IsZero() || requestDeadline.Before(deadline)) {
+			deadline = requestDeadline
+		}
+		connection.SetReadDeadline(deadline)
+	}
+	return connection.Read(buffer)
+}
+
+func timeoutError(received time.Time) HTTPError {
+	if requestTimeout > 0 && !time.Now().Before(received.Add(requestTimeout)) {
+		return HTTPError{StatusCode: "503", Message: "request was not received within the request timeout"}
+	}
+	return HTTPError{StatusCode: "408", Message: "request stalled for longer than the read timeout"}
+}
+
+// expectsContinue reports whether the client is holding its body back until
+// it sees an interim 100 response (RFC 9110 section 10.1.1).
+func expectsContinue(req HttpRequest) bool {
+	return req.Version == "HTTP/1.1" && strings.EqualFold(strings.TrimSpace(req.Expect), "100-continue")
+}
+
+func writeContinue(connection net.Conn, received time.Time) {
+	deadline := time.Time{}
+	if requestTimeout > 0 {
+		deadline = received.Add(requestTimeout)
+	}
+	connection.SetWriteDeadline(deadline)
+	connection.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+}
+
+func isChunked(req HttpRequest) bool {
+	return strings.EqualFold(strings.TrimSpace(req.TransferEncoding), "chunked")
+}
+
+var errIncompleteChunk = errors.New("incomplete chunked body")
+
+var errBodyTooLarge = errors.New("request body is too large")
+
+// forbiddenTrailers may not be sent after the last chunk because they
+// affect framing, routing or authentication (RFC 9110 section 6.5.1).
+var forbiddenTrailers = map[string]bool{
+	"authorization":     true,
+	"content-encoding":  true,
+	"content-length":    true,
+	"content-range":     true,
+	"content-type":      true,
+	"host":              true,
+	"trailer":           true,
+	"transfer-encoding": true,
+}
+
+// chunkDecoder decodes a chunked body as it arrives. Each advance resumes
+// at offset and only consumes complete size lines, chunks and trailers, so
+// a body read in many pieces is still decoded in linear time.
+type chunkDecoder struct {
+	body     []byte
+	offset   int
+	trailers bool
+}
+
+// advance decodes what it can of data, which must extend the data passed
+// before. It reports true once the last chunk and trailer section are in.
+func (d *chunkDecoder) advance(data []byte) (bool, error) {
+	crlf := []byte("\r\n")
+
+	for {
+		lineEnd := bytes.Index(data[d.offset:], crlf)
+		if lineEnd == -1 {
+			if len(data)-d.offset > maxHeaderBytes {
+				return false, errors.New("chunk line is too long")
+			}
+			return false, nil
+		}
+		line := data[d.offset : d.offset+lineEnd]
+
+		if d.trailers {
+			if lineEnd == 0 {
+				d.offset += 2
+				return true, nil
+			}
+
+			name, _, _ := strings.Cut(string(line), ":")
+			if forbiddenTrailers[strings.ToLower(strings.TrimSpace(name))] {
+				return false, fmt.Errorf("trailer field %q is not allowed", name)
+			}
+			d.offset += lineEnd + 2
+			continue
+		}
+
+		size, err := parseChunkSize(line)
+		if err != nil {
+			return false, err
+		}
+		if size == 0 {
+			d.trailers = true
+			d.offset += lineEnd + 2
+			continue
+		}
+		if size > int64(maxBodyBytes-len(d.body)) {
+			return false, errBodyTooLarge
+		}
+
+		start := d.offset + lineEnd + 2
+		if int64(len(data)-start) < size+2 {
+			return false, nil
+		}
+		end := start + int(size)
+		if !bytes.Equal(data[end:end+2], crlf) {
+			return false, fmt.Errorf("missing CRLF after %d byte chunk", size)
+		}
+
+		d.body = append(d.body, data[start:end]...)
+		d.offset = end + 2
+	}
+}
+
+// parseChunkSize reads the 1*HEXDIG size before any chunk extension, so
+// signs, prefixes and spaces inside the number are rejected.
+func parseChunkSize(line []byte) (int64, error) {
+	sizeField, _, _ := strings.Cut(string(line), ";")
+	sizeField = strings.TrimRight(sizeField, " \t")
+
+	if sizeField == "" || len(sizeField) > 15 {
+		return 0, fmt.Errorf("invalid chunk size %q", sizeField)
+	}
+	for _, c := range sizeField {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return 0, fmt.Errorf("invalid chunk size %q", sizeField)
+		}
+	}
+
+	return strconv.ParseInt(sizeField, 16, 64)
+}
+
+// dechunk decodes a complete chunked body, returning how many bytes it
+// consumed. On errIncompleteChunk the bytes decoded so far are returned.
+func dechunk(data []byte) ([]byte, int, error) {
+	var decoder chunkDecoder
+
+	done, err := decoder.advance(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !done {
+		return decoder.body, 0, errIncompleteChunk
+	}
+	return decoder.body, decoder.offset, nil
+}
+
+func headerBoundary(data []byte) (int, int) {
+	if headerEnd := bytes.Index(data, []byte("\r\n\r\n")); headerEnd != -1 {
+		return headerEnd, headerEnd + 4
+	}
+
+	// An HTTP/0.9 simple request is one "GET <target>" line with no header
+	// block to wait for. Any other line still waits for its headers.
+	if lineEnd := bytes.Index(data, []byte("\r\n")); lineEnd != -1 && allowHTTP09 && isSimpleRequestLine(string(data[:lineEnd])) {
+		return lineEnd, lineEnd + 2
+	}
+
+	return -1, -1
+}
+
+// isSimpleRequestLine splits on single spaces the way RequestDecoder does.
+func isSimpleRequestLine(line string) bool {
+	parts := strings.Split(line, " ")
+	return len(parts) == 2 && parts[0] == "GET" && parts[1] != ""
+}
+
+func writeResponse(connection net.Conn, data []byte) {
+	if responseRate <= 0 {
+		connection.Write(data)
+		return
+	}
+
+	chunkSize := max(responseRate/10, 1)
+	start := time.Now()
+
+	for written := 0; written < len(data); {
+		end := min(written+chunkSize, len(data))
+		if _, err := connection.Write(data[written:end]); err != nil {
+			return
+		}
+		written = end
+
+		due := start.Add(time.Duration(written) * time.Second / time.Duration(responseRate))
+		time.Sleep(time.Until(due))
+	}
+}
+
+// writePacedChunks sends the head straight away and then each chunk
+// ChunkInterval after the previous one, so the body really arrives
+// gradually instead of in the single write ResponseEncoder's output gets.
+func writePacedChunks(connection net.Conn, res HttpResponse) {
+	writeResponse(connection, encodeResponseHead(res))
+
+	for i, chunk := range responseChunks(res) {
+		if i > 0 {
+			time.Sleep(res.ChunkInterval)
+		}
+		writeResponse(connection, encodeChunk(chunk))
+	}
+	writeResponse(connection, []byte("0\r\n\r\n"))
+}
+
+func ServeRequest(req HttpRequest) HttpResponse {
+	res := HandleRequest(req)
+	if req.Version == "HTTP/0.9" && allowHTTP09 {
+		res.Version = "HTTP/0.9"
+	}
+	if res.Connection == "" {
+		res.Connection = "close"
+		if wantsKeepAlive(req) {
+			res.Connection = "keep-alive"
+		}
+	}
+	if chunkedThreshold > 0 && len(res.Data) > chunkedThreshold && req.Version == "HTTP/1.1" && res.Version == "HTTP/1.1" {
+		res.Chunked = true
+	}
+
+	if requestID := req.Headers.Get("X-Request-Id"); requestID != "" && isRequestID(requestID) {
+		if res.Headers == nil {
+			res.Headers = make(map[string]string)
+		}
+		res.Headers["X-Request-Id"] = requestID
+	}
+
+	for name, value := range injectedHeaders {
+		if res.Headers == nil {
+			res.Headers = make(map[string]string)
+		}
+		if _, ok := res.Headers[name]; !ok {
+			res.Headers[name] = value
+		}
+	}
+
+	return res
+}
+
+func HandleRequest(req HttpRequest) HttpResponse {
+	if req.DecodeError.StatusCode != "" {
+		response := errorResponse(req, req.DecodeError)
+		response.Connection = "close"
+		return response
+	}
+
+	// A request line that cannot be parsed leaves the connection's framing
+	// in doubt, so these errors close it.
+	if !isToken(req.Method) {
+		response := errorResponse(req, HTTPError{StatusCode: "400", Message: "invalid request method"})
+		response.Connection = "close"
+		return response
+	}
+
+	if req.Method == "CONNECT" {
+		return errorResponse(req, HTTPError{StatusCode: "501", Message: "CONNECT tunneling is not supported by this server"})
+	}
+
+	if req.Version == "HTTP/0.9" && (!allowHTTP09 || req.Method != "GET") {
+		response := errorResponse(req, HTTPError{StatusCode: "400", Message: "HTTP/0.9 requests are not accepted"})
+		response.Connection = "close"
+		return response
+	}
+
+	if req.Method == "HEAD" {
+		// Answer exactly as GET would, keeping Content-Length but no body.
+		getReq := req
+		getReq.Method = "GET"
+		response := HandleRequest(getReq)
+		response.Data = nil
+		response.Chunks = nil
+		response.Chunked = false
+		return response
+	}
+
+	if len(allowedHosts) > 0 && !allowedHosts[strings.ToLower(stripPort(req.Host))] {
+		return errorResponse(req, HTTPError{StatusCode: "421", Message: "host is not served by this server"})
+	}
+
+	if req.Expect != "" && !strings.EqualFold(strings.TrimSpace(req.Expect), "100-continue") {
+		response := errorResponse(req, HTTPError{StatusCode: "417", Message: "only 100-continue expectations are supported"})
+		response.Connection = "close"
+		return response
+	}
+
+	// Some clients gzip the body but forget to say so.
+	if sniffGzipBody && len(req.Headers.Values("Content-Encoding")) == 0 && bytes.HasPrefix(req.Body, []byte{0x1f, 0x8b}) {
+		body, err := gunzipBody(req.Body)
+		if errors.Is(err, errBodyTooLarge) {
+			return errorResponse(req, HTTPError{StatusCode: "413", Message: "decompressed request body is too large"})
+		}
+		if err != nil {
+			return errorResponse(req, HTTPError{StatusCode: "400", Message: "request body looks gzipped but does not decompress"})
+		}
+		req.Body = body
+		req.ContentLength = len(body)
+	}
+
+	parsedURL, err := url.Parse(req.Uri)
+	if err != nil {
+		return errorResponse(req, HTTPError{StatusCode: "400", Message: "malformed request target"})
+	}
+
+	path := parsedURL.Path
+
+	if !routeEnabled(routeName(path)) {
+		return errorResponse(req, HTTPError{StatusCode: "503", Message: "route is disabled for maintenance"})
+	}
+
+	return router.ServeRequest(req)
+}
+
+type HandlerFunc func(req HttpRequest) HttpResponse
+
+type route struct {
+	method  string
+	pattern string
+	handler HandlerFunc
+}
+
+// Router dispatches to the first registered route whose pattern matches the
+// request path. A "*" method matches any method; a path that only matches
+// under other methods gets 405. OPTIONS is answered from the registrations.
+type Router struct {
+	routes []route
+}
+
+var router = newRouter()
+
+func newRouter() *Router {
+	r := &Router{}
+	r.Handle("GET", "/", handleRoot)
+	r.Handle("GET", "/echo", handleEcho)
+	r.Handle("POST", "/echo", handleEcho)
+	r.Handle("PUT", "/echo", handleEcho)
+	r.Handle("GET", "/echo/headers", handleEchoHeaders)
+	r.Handle("GET", "/gzip-test", handleGzipTest)
+	r.Handle("GET", "/admin/config", handleAdminConfig)
+	r.Handle("GET", "/admin/routes", handleAdminRoutes)
+	r.Handle("POST", "/admin/routes", handleAdminRoutes)
+	r.Handle("GET", "/debug/runtime", handleDebugRuntime)
+	r.Handle("GET", "/health", handleHealth)
+	r.Handle("GET", "/stream", handleStream)
+	r.Handle("GET", "/slow-stream", handleSlowStream)
+	r.Handle("GET", "/greet/:npm", handleGreet)
+	r.Handle("POST", "/form", handleForm)
+	r.Handle("POST", "/upload", handleUpload)
+	return r
+}
+
+func (r *Router) Handle(method string, pattern string, h HandlerFunc) {
+	r.routes = append(r.routes, route{method: method, pattern: pattern, handler: h})
+}
+
+func (r *Router) ServeRequest(req HttpRequest) HttpResponse {
+	parsedURL, err := url.Parse(req.Uri)
+	if err != nil {
+		return errorResponse(req, HTTPError{StatusCode: "400", Message: "malformed request target"})
+	}
+
+	path := parsedURL.Path
+	if path == "*" && req.Method != "OPTIONS" {
+		return errorResponse(req, HTTPError{StatusCode: "400", Message: "the * request target is only valid for OPTIONS"})
+	}
+
+	for _, rt := range r.routes {
+		params, ok := matchPath(rt.pattern, path)
+		if ok && (rt.method == "*" || rt.method == req.Method) {
+			req.Params = params
+			return rt.handler(req)
+		}
+	}
+
+	allowed := r.Allowed(path)
+	if len(allowed) == 0 {
+		return handle404(req)
+	}
+
+	if req.Method == "OPTIONS" {
+		return HttpResponse{
+			Version:         "HTTP/1.1",
+			StatusCode:      "204",
+			ContentEncoding: "none",
+			Headers:         map[string]string{"Allow": strings.Join(allowed, ", ")},
+		}
+	}
+
+	response, _ := requireMethod(req, allowed...)
+	return response
+}
+
+// Allowed lists the methods registered for path, or for every route when
+// path is "*". GET implies HEAD, and OPTIONS is always added.
+func (r *Router) Allowed(path string) []string {
+	var allowed []string
+	seen := map[string]bool{}
+	add := func(methods ...string) {
+		for _, method := range methods {
+			if !seen[method] {
+				seen[method] = true
+				allowed = append(allowed, method)
+			}
+		}
+	}
+
+	for _, rt := range r.routes {
+		if _, ok := matchPath(rt.pattern, path); !ok && path != "*" {
+			continue
+		}
+
+		switch rt.method {
+		case "*":
+			add("GET", "HEAD", "POST", "PUT")
+		case "GET":
+			add("GET", "HEAD")
+		default:
+			add(rt.method)
+		}
+	}
+
+	if len(allowed) > 0 {
+		add("OPTIONS")
+	}
+	return allowed
+}
+
+// matchPath treats a trailing slash as insignificant, so "/greet/:npm"
+// also matches "/greet/2306216636/".
+func matchPath(pattern string, path string) (map[string]string, bool) {
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+
+	patternParts := strings.Split(pattern, "/")
+	pathParts := strings.Split(path, "/")
+	if len(patternParts) != len(pathParts) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, part := range patternParts {
+		if name, ok := strings.CutPrefix(part, ":"); ok && pathParts[i] != "" {
+			params[name] = pathParts[i]
+		} else if part != pathParts[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func requestQuery(req HttpRequest) url.Values {
+	parsedURL, err := url.Parse(req.Uri)
+	if err != nil {
+		return url.Values{}
+	}
+	return parsedURL.Query()
+}
+
+// handleRoot offers the greeting as HTML, JSON or XML. A -root-file page
+// has no structured form, so only HTML is offered then.
+func handleRoot(req HttpRequest) HttpResponse {
+	var payload interface{} = RootResponse{Message: rootMessage}
+	if rootFromFile {
+		payload = nil
+	}
+	return negotiatedResponse(req, payload, rootHTML)
+}
+
+func unacceptableEncoding(req HttpRequest) HttpResponse {
+	var available []string
+	for _, encoding := range supportedEncodings {
+		if enabledEncodings[encoding] {
+			available = append(available, encoding)
+		}
+	}
+	available = append(available, "identity")
+
+	return errorResponse(req, HTTPError{StatusCode: "406", Message: "no acceptable content coding; available: " + strings.Join(available, ", ")})
+}
+
+func handleEcho(req HttpRequest) HttpResponse {
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	response := HttpResponse{
+		Version:         "HTTP/1.1",
+		StatusCode:      "200",
+		ContentType:     contentType,
+		ContentEncoding: "none",
+		Data:            req.Body,
+	}
+
+	response.ContentLength = len(response.Data)
+	return response
+}
+
+func handleEchoHeaders(req HttpRequest) HttpResponse {
+	response := HttpResponse{
+		Version:         "HTTP/1.1",
+		StatusCode:      "200",
+		ContentType:     "text/plain",
+		ContentEncoding: "none",
+		Data:            req.RawHeaders,
+	}
+
+	response.ContentLength = len(response.Data)
+	return response
+}
+
+func handleGreet(req HttpRequest) HttpResponse {
+	if req.Params["npm"] != STUDENT_NPM {
+		return handle404(req)
+	}
+
+	greeterName := STUDENT_NAME
+	if nameParam := requestQuery(req).Get("name"); nameParam != "" {
+		greeterName = nameParam
+	}
+
+	student := Student{
+		Nama: STUDENT_NAME,
+		Npm:  STUDENT_NPM,
+	}
+
+	greetResponse := GreetResponse{
+		Student: student,
+		Greeter: greeterName,
+	}
+
+	return negotiatedResponse(req, greetResponse, nil)
+}
+
+var errNotForm = errors.New("request body is not application/x-www-form-urlencoded")
+
+// parseForm decodes an application/x-www-form-urlencoded request body.
+func parseForm(req HttpRequest) (url.Values, error) {
+	mediaType, _ := parseHeaderParams(strings.ToLower(req.ContentType))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return nil, errNotForm
+	}
+	return url.ParseQuery(string(req.Body))
+}
+
+// handleForm greets the name posted in a form, like /greet does for ?name=.
+func handleForm(req HttpRequest) HttpResponse {
+	form, err := parseForm(req)
+	if errors.Is(err, errNotForm) {
+		return errorResponse(req, HTTPError{StatusCode: "415", Message: err.Error()})
+	}
+	if err != nil {
+		return errorResponse(req, HTTPError{StatusCode: "400", Message: "malformed form body"})
+	}
+
+	greeterName := STUDENT_NAME
+	if nameField := form.Get("name"); nameField != "" {
+		greeterName = nameField
+	}
+
+	greetResponse := GreetResponse{
+		Student: Student{Nama: STUDENT_NAME, Npm: STUDENT_NPM},
+		Greeter: greeterName,
+	}
+
+	return negotiatedResponse(req, greetResponse, nil)
+}
+
+// handleUpload stores the first file part of a multipart/form-data body in
+// uploadDir. The body was already held to maxBodyBytes when it was read.
+func handleUpload(req HttpRequest) HttpResponse {
+	if uploadDir == "" {
+		return handle404(req)
+	}
+
+	mediaType, params := parseHeaderParams(req.ContentType)
+	if strings.ToLower(mediaType) != "multipart/form-data" || params["boundary"] == "" {
+		return errorResponse(req, HTTPError{StatusCode: "415", Message: "request body is not multipart/form-data with a boundary"})
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(req.Body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return errorResponse(req, HTTPError{StatusCode: "400", Message: "multipart body has no file part"})
+		}
+		if err != nil {
+			return errorResponse(req, HTTPError{StatusCode: "400", Message: "malformed multipart body"})
+		}
+		if part.FileName() == "" {
+			continue
+		}
+
+		// Only the base name is kept so a crafted filename cannot escape
+		// uploadDir.
+		name := filepath.Base(part.FileName())
+		if name == "." || name == string(filepath.Separator) {
+			return errorResponse(req, HTTPError{StatusCode: "400", Message: "invalid upload filename"})
+		}
+
+		size, err := saveUpload(filepath.Join(uploadDir, name), part)
+		if err != nil {
+			return errorResponse(req, HTTPError{StatusCode: "500", Message: "failed to store upload"})
+		}
+
+		responseData, err := json.Marshal(UploadResponse{Name: name, Size: size})
+		if err != nil {
+			return errorResponse(req, HTTPError{StatusCode: "500", Message: "failed to encode response"})
+		}
+
+		response := HttpResponse{
+			Version:         "HTTP/1.1",
+			StatusCode:      "201",
+			ContentType:     "application/json",
+			ContentEncoding: "none",
+			Data:            responseData,
+		}
+
+		response.ContentLength = len(response.Data)
+		return response
+	}
+}
+
+func saveUpload(path string, part io.Reader) (int64, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := io.Copy(file, part)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return size, err
+}
+
+// negotiatedResponse sends html as text/html and payload marshaled as JSON
+// or XML, whichever Accept prefers among those given (html first, nil
+// leaves a form out), then applies the negotiated charset and coding.
+func negotiatedResponse(req HttpRequest, payload interface{}, html []byte) HttpResponse {
+	var offered []string
+	if html != nil {
+		offered = append(offered, "text/html")
+	}
+	if payload != nil {
+		offered = append(offered, "application/json", "application/xml")
+	}
+
+	contentType := negotiateContentType(req.Accept, offered)
+	if contentType == "" {
+		return errorResponse(req, HTTPError{StatusCode: "406", Message: "no acceptable media type; available: " + strings.Join(offered, ", ")})
+	}
+
+	var responseData []byte
+	var err error
+
+	switch contentType {
+	case "text/html":
+		responseData = html
+	case "application/xml":
+		responseData, err = xml.Marshal(payload)
+	default:
+		escapeHTML := jsonEscapeHTML
+		if escapeParam := requestQuery(req).Get("escape_html"); escapeParam != "" {
+			escapeHTML, err = strconv.ParseBool(escapeParam)
+			if err != nil {
+				return errorResponse(req, HTTPError{StatusCode: "400", Message: "escape_html must be a boolean"})
+			}
+		}
+
+		responseData, err = marshalJSON(payload, escapeHTML)
+	}
+
+	if err != nil {
+		return errorResponse(req, HTTPError{StatusCode: "500", Message: "failed to encode response"})
+	}
+
+	contentType, responseData, ok := encodeCharset(req, contentType, responseData)
+	if !ok {
+		return errorResponse(req, HTTPError{StatusCode: "406", Message: "no acceptable charset"})
+	}
+
+	encoding := negotiateEncoding(req.AcceptEncoding)
+	if encoding == "" {
+		return unacceptableEncoding(req)
+	}
+
+	responseData, encoding = compressBody(responseData, contentType, encoding)
+
+	response := HttpResponse{
+		Version:         "HTTP/1.1",
+		StatusCode:      "200",
+		ContentType:     contentType,
+		ContentEncoding: encoding,
+		Headers:         map[string]string{"Vary": "Accept, Accept-Charset, Accept-Encoding"},
+		Data:            responseData,
+	}
+
+	response.ContentLength = len(response.Data)
+	return response
+}
+
+func handleGzipTest(req HttpRequest) HttpResponse {
+	size := GZIP_TEST_DEFAULT_SIZE
+	if sizeParam := requestQuery(req).Get("size"); sizeParam != "" {
+		parsedSize, err := strconv.Atoi(sizeParam)
+		if err != nil || parsedSize < 0 || parsedSize > GZIP_TEST_MAX_SIZE {
+			return errorResponse(req, HTTPError{StatusCode: "400", Message: "size must be between 0 and " + strconv.Itoa(GZIP_TEST_MAX_SIZE)})
+		}
+		size = parsedSize
+	}
+
+	pattern := []byte("Halo, dunia! Aku sedang mengerjakan A03. ")
+	responseData := bytes.Repeat(pattern, size/len(pattern)+1)[:size]
+
+	encoding := negotiateEncoding(req.AcceptEncoding)
+	if encoding == "" {
+		return unacceptableEncoding(req)
+	}
+
+	contentType, responseData, ok := encodeCharset(req, "text/plain", responseData)
+	if !ok {
+		return errorResponse(req, HTTPError{StatusCode: "406", Message: "no acceptable charset"})
+	}
+
+	responseData, encoding = compressBody(responseData, contentType, encoding)
+
+	response := HttpResponse{
+		Version:         "HTTP/1.1",
+		StatusCode:      "200",
+		ContentType:     contentType,
+		ContentEncoding: encoding,
+		Headers:         map[string]string{"Vary": "Accept-Charset, Accept-Encoding"},
+		Data:            responseData,
+	}
+
+	response.ContentLength = len(response.Data)
+	return response
+}
+
+func handleAdminConfig(req HttpRequest) HttpResponse {
+	if response, ok := requireAdmin(req); !ok {
+		return response
+	}
+
+	config := ServerConfig{
+		Host:                  serverHost,
+		Port:                  serverPort,
+		CompressibleTypes:     compressibleTypes,
+		DefaultAcceptEncoding: defaultAcceptEncoding,
+		MinCompressionRatio:   minCompressionRatio,
+		MaxHeaderBytes:        maxHeaderBytes,
+		MaxBodyBytes:          maxBodyBytes,
+		KeepAliveTimeout:      keepAliveTimeout.String(),
+		ReadTimeout:           readTimeout.String(),
+		RequestTimeout:        requestTimeout.String(),
+		ShutdownTimeout:       shutdownTimeout.String(),
+		MaxKeepAlive:          maxKeepAlive,
+		MaxConnections:        maxConnections,
+		ResponseRate:          responseRate,
+		ChunkedThreshold:      chunkedThreshold,
+		JSONEscapeHTML:        jsonEscapeHTML,
+		StrictFraming:         strictFraming,
+		StrictAccept:          strictAccept,
+		StrictCharset:         strictCharset,
+		AllowHTTP09:           allowHTTP09,
+		LenientEOFBody:        lenientEOFBody,
+		SniffGzipBody:         sniffGzipBody,
+		UploadDir:             uploadDir,
+		InjectedHeaders:       injectedHeaders,
+	}
+
+	for _, encoding := range supportedEncodings {
+		if enabledEncodings[encoding] {
+			config.EnabledEncodings = append(config.EnabledEncodings, encoding)
+		}
+	}
+
+	for host := range allowedHosts {
+		config.AllowedHosts = append(config.AllowedHosts, host)
+	}
+	sort.Strings(config.AllowedHosts)
+
+	for _, network := range trustedProxies {
+		config.TrustedProxies = append(config.TrustedProxies, network.String())
+	}
+
+	responseData, err := json.Marshal(config)
+	if err != nil {
+		return errorResponse(req, HTTPError{StatusCode: "500", Message: "failed to encode response"})
+	}
+
+	response := HttpResponse{
+		Version:         "HTTP/1.1",
+		StatusCode:      "200",
+		ContentType:     "application/json",
+		ContentEncoding: "none",
+		Data:            responseData,
+	}
+
+	response.ContentLength = len(response.Data)
+	return response
+}
+
+func handleAdminRoutes(req HttpRequest) HttpResponse {
+	if response, ok := requireAdmin(req); !ok {
+		return response
+	}
+
+	// GET only lists; changing a route's state takes a POST.
+	query := requestQuery(req)
+	if route := routeName(query.Get("route")); route != "" && req.Method == "POST" {
+		if strings.HasPrefix(route, "/admin/") {
+			return errorResponse(req, HTTPError{StatusCode: "400", Message: "admin routes cannot be disabled"})
+		}
+
+		enabled, err := strconv.ParseBool(query.Get("enabled"))
+		if err != nil {
+			return errorResponse(req, HTTPError{StatusCode: "400", Message: "enabled must be a boolean"})
+		}
+		setRouteEnabled(route, enabled)
+	}
+
+	disabledRoutes.RLock()
+	disabled := make([]string, 0, len(disabledRoutes.routes))
+	for route := range disabledRoutes.routes {
+		disabled = append(disabled, route)
+	}
+	disabledRoutes.RUnlock()
+	sort.Strings(disabled)
+
+	responseData, err := json.Marshal(map[string][]string{"disabled_routes": disabled})
+	if err != nil {
+		return errorResponse(req, HTTPError{StatusCode: "500", Message: "failed to encode response"})
+	}
+
+	response := HttpResponse{
+		Version:         "HTTP/1.1",
+		StatusCode:      "200",
+		ContentType:     "application/json",
+		ContentEncoding: "none",
+		Data:            responseData,
+	}
+
+	response.ContentLength = len(response.Data)
+	return response
+}
+
+// handleStream sends count NDJSON objects, one per chunk on HTTP/1.1.
+func handleStream(req HttpRequest) HttpResponse {
+	count := STREAM_DEFAULT_COUNT
+	if countParam := requestQuery(req).Get("count"); countParam != "" {
+		parsedCount, err := strconv.Atoi(countParam)
+		if err != nil || parsedCount < 1 || parsedCount > STREAM_MAX_COUNT {
+			return errorResponse(req, HTTPError{StatusCode: "400", Message: "count must be between 1 and " + strconv.Itoa(STREAM_MAX_COUNT)})
+		}
+		count = parsedCount
+	}
+
+	var chunks [][]byte
+	for seq := 1; seq <= count; seq++ {
+		event := StreamEvent{
+			Seq:     seq,
+			Student: Student{Nama: STUDENT_NAME, Npm: STUDENT_NPM},
+			Message: rootMessage,
+		}
+
+		line, err := marshalJSON(event, jsonEscapeHTML)
+		if err != nil {
+			return errorResponse(req, HTTPError{StatusCode: "500", Message: "failed to encode response"})
+		}
+		chunks = append(chunks, append(line, '\n'))
+	}
+
+	response := HttpResponse{
+		Version:         "HTTP/1.1",
+		StatusCode:      "200",
+		ContentType:     "application/x-ndjson",
+		ContentEncoding: "none",
+		Chunked:         req.Version == "HTTP/1.1",
+		Chunks:          chunks,
+		Data:            bytes.Join(chunks, nil),
+	}
+
+	response.ContentLength = len(response.Data)
+	return response
+}
+
+// handleSlowStream sends count lines as chunks delay apart, for testing
+// client timeouts and time to first byte. The whole stream is capped at
+// SLOW_STREAM_MAX_DURATION. HTTP/1.0 clients get the lines in one body.
+func handleSlowStream(req HttpRequest) HttpResponse {
+	query := requestQuery(req)
+
+	count := SLOW_STREAM_DEFAULT_COUNT
+	if countParam := query.Get("count"); countParam != "" {
+		parsedCount, err := strconv.Atoi(countParam)
+		if err != nil || parsedCount < 1 || parsedCount > STREAM_MAX_COUNT {
+			return errorResponse(req, HTTPError{StatusCode: "400", Message: "count must be between 1 and " + strconv.Itoa(STREAM_MAX_COUNT)})
+		}
+		count = parsedCount
+	}
+
+	delay := SLOW_STREAM_DEFAULT_DELAY
+	if delayParam := query.Get("delay"); delayParam != "" {
+		parsedDelay, err := time.ParseDuration(delayParam)
+		if err != nil || parsedDelay < 0 {
+			return errorResponse(req, HTTPError{StatusCode: "400", Message: "delay must be a non-negative duration such as 200ms"})
+		}
+		delay = parsedDelay
+	}
+
+	if time.Duration(count-1)*delay > SLOW_STREAM_MAX_DURATION {
+		return errorResponse(req, HTTPError{StatusCode: "400", Message: "the stream may last at most " + SLOW_STREAM_MAX_DURATION.String()})
+	}
+
+	var chunks [][]byte
+	for i := 1; i <= count; i++ {
+		chunks = append(chunks, []byte(fmt.Sprintf("chunk %d of %d\n", i, count)))
+	}
+
+	response := HttpResponse{
+		Version:         "HTTP/1.1",
+		StatusCode:      "200",
+		ContentType:     "text/plain",
+		ContentEncoding: "none",
+		Chunked:         req.Version == "HTTP/1.1",
+		Chunks:          chunks,
+		ChunkInterval:   delay,
+		Data:            bytes.Join(chunks, nil),
+	}
+
+	response.ContentLength = len(response.Data)
+	return response
+}
+
+func handleHealth(req HttpRequest) HttpResponse {
+	health := HealthResponse{
+		Status:        "ok",
+		UptimeSeconds: int64(timeNow().Sub(startTime).Seconds()),
+	}
+
+	responseData, err := json.Marshal(health)
+	if err != nil {
+		return errorResponse(req, HTTPError{StatusCode: "500", Message: "failed to encode response"})
+	}
+
+	response := HttpResponse{
+		Version:         "HTTP/1.1",
+		StatusCode:      "200",
+		ContentType:     "application/json",
+		ContentEncoding: "none",
+		Data:            responseData,
+	}
+
+	response.ContentLength = len(response.Data)
+	return response
+}
+
+func handleDebugRuntime(req HttpRequest) HttpResponse {
+	if response, ok := requireAdmin(req); !ok {
+		return response
+	}
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	stats := RuntimeStats{
+		Goroutines:        runtime.NumGoroutine(),
+		ActiveConnections: activeConns.Load(),
+		KeepAliveConns:    keepAliveConns.Load(),
+		HeapAllocBytes:    memStats.HeapAlloc,
+		HeapObjects:       memStats.HeapObjects,
+		TotalAllocBytes:   memStats.TotalAlloc,
+		SysBytes:          memStats.Sys,
+		NumGC:             memStats.NumGC,
+	}
+
+	responseData, err := json.Marshal(stats)
+	if err != nil {
+		return errorResponse(req, HTTPError{StatusCode: "500", Message: "failed to encode response"})
+	}
+
+	response := HttpResponse{
+		Version:         "HTTP/1.1",
+		StatusCode:      "200",
+		ContentType:     "application/json",
+		ContentEncoding: "none",
+		Data:            responseData,
+	}
+
+	response.ContentLength = len(response.Data)
+	return response
+}
+
+// routeName normalizes path the way matchPath does, so "/health/" and
+// "/health" share one enabled state.
+func routeName(path string) string {
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	if strings.HasPrefix(path, "/greet/") {
+		return "/greet"
+	}
+	return path
+}
+
+func routeEnabled(route string) bool {
+	disabledRoutes.RLock()
+	defer disabledRoutes.RUnlock()
+	return !disabledRoutes.routes[route]
+}
+
+func setRouteEnabled(route string, enabled bool) {
+	disabledRoutes.Lock()
+	defer disabledRoutes.Unlock()
+
+	if enabled {
+		delete(disabledRoutes.routes, route)
+	} else {
+		disabledRoutes.routes[route] = true
+	}
+}
+
+func requireAdmin(req HttpRequest) (HttpResponse, bool) {
+	if adminToken == "" {
+		return handle404(req), false
+	}
+
+	token, found := strings.CutPrefix(req.Authorization, "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(adminToken)) != 1 {
+		response := errorResponse(req, HTTPError{StatusCode: "401", Message: "missing or invalid admin token"})
+		response.Headers = map[string]string{"WWW-Authenticate": "Bearer"}
+		return response, false
+	}
+
+	return HttpResponse{}, true
+}
+
+func requireMethod(req HttpRequest, allowed ...string) (HttpResponse, bool) {
+	for _, method := range allowed {
+		if req.Method == method {
+			return HttpResponse{}, true
+		}
+	}
+
+	allow := strings.Join(allowed, ", ")
+	response := errorResponse(req, HTTPError{StatusCode: "405", Message: req.Method + " is not allowed here; allowed methods: " + allow})
+	response.Headers = map[string]string{"Allow": allow}
+	return response, false
+}
+
+func marshalJSON(v interface{}, escapeHTML bool) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(escapeHTML)
+
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
 }
 
-type GreetResponse struct {
-	Student Student
-	Greeter string
+func handle404(req HttpRequest) HttpResponse {
+	return errorResponse(req, HTTPError{StatusCode: "404"})
 }
 
-type HttpRequest struct {
-	Method         string
-	Uri            string
-	Version        string
-	Host           string
-	Accept         string
-	AcceptEncoding string
-}
+// RegisterStatusTemplate replaces the body sent for statusCode to clients
+// negotiating contentType. text/html templates are parsed with html/template
+// so page fields are escaped; others get a json function for quoting values.
+func RegisterStatusTemplate(statusCode string, contentType string, body string) error {
+	var tmpl statusTemplate
+	var err error
 
-type HttpResponse struct {
-	Version         string
-	StatusCode      string
-	ContentType     string
-	ContentEncoding string
-	ContentLength   int
-	Data            []byte
+	name := statusCode + " " + contentType
+	if contentType == "text/html" {
+		tmpl, err = htmltemplate.New(name).Parse(body)
+	} else {
+		tmpl, err = template.New(name).Funcs(template.FuncMap{"json": jsonTemplateValue}).Parse(body)
+	}
+	if err != nil {
+		return err
+	}
+
+	if statusTemplates[statusCode] == nil {
+		statusTemplates[statusCode] = make(map[string]statusTemplate)
+	}
+	statusTemplates[statusCode][contentType] = tmpl
+	return nil
 }
 
-func main() {
-	listener, err := net.Listen(SERVER_TYPE, SERVER_HOST+":"+SERVER_PORT)
+func registerStatusTemplateFile(value string) error {
+	statusCode, path, ok := strings.Cut(value, "=")
+	if _, err := strconv.Atoi(statusCode); !ok || err != nil || len(statusCode) != 3 {
+		return fmt.Errorf("%q must have the form CODE=FILE", value)
+	}
+
+	var contentType string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		contentType = "text/html"
+	case ".json":
+		contentType = "application/json"
+	default:
+		return fmt.Errorf("%s: template files must end in .html or .json", path)
+	}
+
+	body, err := os.ReadFile(path)
 	if err != nil {
-		fmt.Printf("Error starting server: %v\n", err)
-		return
+		return err
 	}
-	defer listener.Close()
+	return RegisterStatusTemplate(statusCode, contentType, string(body))
+}
 
-	fmt.Printf("Server listening on %s:%s\n", SERVER_HOST, SERVER_PORT)
+func jsonTemplateValue(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
 
-	for {
-		connection, err := listener.Accept()
-		if err != nil {
-			fmt.Printf("Error accepting connection: %v\n", err)
-			continue
+func defaultStatusBody(contentType string, page StatusPage) []byte {
+	if contentType == "application/json" {
+		status, _ := strconv.Atoi(page.StatusCode)
+		data, _ := json.Marshal(StatusBody{Status: status, Message: page.Message})
+		return data
+	}
+
+	var buf bytes.Buffer
+	defaultHTMLStatusTemplate.Execute(&buf, page)
+	return buf.Bytes()
+}
+
+func errorResponse(req HttpRequest, httpErr HTTPError) HttpResponse {
+	statusCode := httpErr.StatusCode
+	// Error pages are never refused: without an acceptable type they are HTML.
+	contentType := negotiateContentType(req.Accept, []string{"text/html", "application/json"})
+	if contentType == "" {
+		contentType = "text/html"
+	}
+
+	page := StatusPage{
+		StatusCode: statusCode,
+		Message:    httpErr.Message,
+		Path:       req.Uri,
+	}
+	if page.Message == "" {
+		page.Message = reasonPhrase(statusCode)
+	}
+
+	body := defaultStatusBody(contentType, page)
+	if tmpl, ok := statusTemplates[statusCode][contentType]; ok {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, page); err == nil {
+			body = buf.Bytes()
 		}
+	}
 
-		go HandleConnection(connection)
+	response := HttpResponse{
+		Version:         "HTTP/1.1",
+		StatusCode:      statusCode,
+		ContentType:     contentType,
+		ContentEncoding: "none",
+		Data:            body,
 	}
-}
 
-func HandleConnection(connection net.Conn) {
-	defer connection.Close()
+	if strings.HasPrefix(statusCode, "5") {
+		response.Connection = "close"
+	}
 
-	buffer := make([]byte, BUFFER_SIZE)
-	var requestData []byte
+	response.ContentLength = len(response.Data)
+	return response
+}
 
-	for {
-		n, err := connection.Read(buffer)
-		if err != nil {
-			if n == 0 {
-				break
+type mediaRange struct {
+	MediaType string
+	Quality   float64
+}
+
+// negotiateContentType picks from offered, in server preference order,
+// the type whose most specific matching media range has the highest
+// quality (RFC 9110 section 12.5.1). Without an Accept header the first
+// offer wins. When nothing is acceptable it returns "" under strictAccept,
+// and otherwise the first offer the client did not refuse with q=0.
+func negotiateContentType(accept string, offered []string) string {
+	var ranges []mediaRange
+
+	for _, element := range splitHeaderValue(strings.ToLower(accept), ',') {
+		mediaType, params := parseHeaderParams(element)
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
 			}
-			fmt.Printf("Error reading request: %v\n", err)
-			return
+			quality = parsed
 		}
 
-		requestData = append(requestData, buffer[:n]...)
+		ranges = append(ranges, mediaRange{MediaType: mediaType, Quality: quality})
+	}
 
-		requestStr := string(requestData)
-		if strings.Contains(requestStr, "\r\n\r\n") {
-			break
-		}
+	if len(ranges) == 0 {
+		return offered[0]
+	}
 
-		if n < BUFFER_SIZE {
-			break
+	bestType := ""
+	bestQuality := 0.0
+	var unrefused []string
+
+	for _, offer := range offered {
+		quality, matched := mediaTypeQuality(ranges, offer)
+		if quality > bestQuality {
+			bestType = offer
+			bestQuality = quality
+		}
+		if !matched || quality > 0 {
+			unrefused = append(unrefused, offer)
 		}
 	}
 
-	httpReq := RequestDecoder(requestData)
+	if bestType != "" || strictAccept || len(unrefused) == 0 {
+		return bestType
+	}
+	return unrefused[0]
+}
+
+// mediaTypeQuality returns the quality of the most specific range in
+// ranges matching mediaType, and whether any range matched at all.
+func mediaTypeQuality(ranges []mediaRange, mediaType string) (float64, bool) {
+	typeName, _, _ := strings.Cut(mediaType, "/")
+
+	quality := 0.0
+	specificity := -1
+	for _, r := range ranges {
+		rangeSpecificity := -1
+		switch r.MediaType {
+		case mediaType:
+			rangeSpecificity = 2
+		case typeName + "/*":
+			rangeSpecificity = 1
+		case "*/*":
+			rangeSpecificity = 0
+		}
 
-	httpRes := HandleRequest(httpReq)
+		if rangeSpecificity > specificity {
+			quality = r.Quality
+			specificity = rangeSpecificity
+		}
+	}
 
-	responseBytes := ResponseEncoder(httpRes)
-	connection.Write(responseBytes)
+	return quality, specificity >= 0
 }
 
-func HandleRequest(req HttpRequest) HttpResponse {
-	parsedURL, err := url.Parse(req.Uri)
-	if err != nil {
-		return HttpResponse{
-			Version:    "HTTP/1.1",
-			StatusCode: "400",
+func splitHeaderValue(value string, separator byte) []string {
+	var elements []string
+	inQuotes := false
+	start := 0
+
+	for i := 0; i < len(value); i++ {
+		switch {
+		case inQuotes && value[i] == '\\':
+			i++
+		case value[i] == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && value[i] == separator:
+			if element := strings.TrimSpace(value[start:i]); element != "" {
+				elements = append(elements, element)
+			}
+			start = i + 1
 		}
 	}
 
-	path := parsedURL.Path
-	query := parsedURL.Query()
+	if element := strings.TrimSpace(value[start:]); element != "" {
+		elements = append(elements, element)
+	}
 
-	switch path {
-	case "/":
-		return handleRoot(req)
-	default:
-		if strings.HasPrefix(path, "/greet/") {
-			return handleGreet(req, path, query)
+	return elements
+}
+
+func parseHeaderParams(element string) (string, map[string]string) {
+	parts := splitHeaderValue(element, ';')
+	params := make(map[string]string)
+
+	if len(parts) == 0 {
+		return "", params
+	}
+
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(part, "=")
+		params[strings.ToLower(strings.TrimSpace(name))] = unquoteHeaderValue(strings.TrimSpace(value))
+	}
+
+	return parts[0], params
+}
+
+func unquoteHeaderValue(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+
+	var unquoted strings.Builder
+	for i := 1; i < len(value)-1; i++ {
+		if value[i] == '\\' && i+1 < len(value)-1 {
+			i++
 		}
-		return handle404()
+		unquoted.WriteByte(value[i])
 	}
+
+	return unquoted.String()
 }
 
-func handleRoot(req HttpRequest) HttpResponse {
-	htmlContent := fmt.Sprintf("<html><body><h1>Halo, dunia! Aku %s sedang mengerjakan A03</h1></body></html>", STUDENT_NAME)
+func parseCookies(header string) map[string]string {
+	cookies := make(map[string]string)
 
-	response := HttpResponse{
-		Version:         "HTTP/1.1",
-		StatusCode:      "200",
-		ContentType:     "text/html",
-		ContentEncoding: "none",
-		Data:            []byte(htmlContent),
+	for _, pair := range splitHeaderValue(header, ';') {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		cookies[strings.TrimSpace(name)] = unquoteHeaderValue(strings.TrimSpace(value))
 	}
 
-	response.ContentLength = len(response.Data)
-	return response
+	return cookies
 }
 
-func handleGreet(req HttpRequest, path string, query url.Values) HttpResponse {
-	parts := strings.Split(path, "/")
-	if len(parts) < 3 {
-		return handle404()
+// negotiateEncoding returns "none" for an identity body, or "" when nothing
+// acceptable is enabled. The client's "none" sentinel means identity.
+func negotiateEncoding(acceptEncoding string) string {
+	acceptEncoding = strings.ToLower(acceptEncoding)
+
+	if acceptEncoding == "none" {
+		return "none"
 	}
 
-	npm := parts[2]
-	if npm != STUDENT_NPM {
-		return handle404()
+	qualities := make(map[string]float64)
+	for _, element := range splitHeaderValue(acceptEncoding, ',') {
+		coding, params := parseHeaderParams(element)
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+
+		qualities[coding] = quality
 	}
 
-	greeterName := STUDENT_NAME
-	if nameParam := query.Get("name"); nameParam != "" {
-		greeterName = nameParam
+	codingQuality := func(coding string) float64 {
+		if quality, ok := qualities[coding]; ok {
+			return quality
+		}
+		if quality, ok := qualities["*"]; ok && !explicitOnlyEncodings[coding] {
+			return quality
+		}
+		if coding == "identity" {
+			// Unlisted identity stays acceptable but loses to any listed coding.
+			return 0.001
+		}
+		return 0
 	}
 
-	student := Student{
-		Nama: STUDENT_NAME,
-		Npm:  STUDENT_NPM,
+	bestEncoding := ""
+	bestQuality := 0.0
+	for _, encoding := range supportedEncodings {
+		if quality := codingQuality(encoding); enabledEncodings[encoding] && quality > bestQuality {
+			bestEncoding = encoding
+			bestQuality = quality
+		}
 	}
 
-	greetResponse := GreetResponse{
-		Student: student,
-		Greeter: greeterName,
+	if identityQuality := codingQuality("identity"); identityQuality > bestQuality {
+		return "none"
 	}
 
-	contentType := determineContentType(req.Accept)
+	return bestEncoding
+}
 
-	var responseData []byte
-	var err error
+func negotiateCharset(acceptCharset string) string {
+	if strings.TrimSpace(acceptCharset) == "" {
+		return "utf-8"
+	}
 
-	if contentType == "application/xml" {
-		responseData, err = xml.Marshal(greetResponse)
-	} else {
-		contentType = "application/json"
-		responseData, err = json.Marshal(greetResponse)
+	qualities := make(map[string]float64)
+	for _, element := range splitHeaderValue(strings.ToLower(acceptCharset), ',') {
+		charset, params := parseHeaderParams(element)
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			parsed, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			quality = parsed
+		}
+
+		qualities[charset] = quality
 	}
 
-	if err != nil {
-		return HttpResponse{
-			Version:    "HTTP/1.1",
-			StatusCode: "500",
+	bestCharset := ""
+	bestQuality := 0.0
+	for _, charset := range supportedCharsets {
+		quality, ok := qualities[charset]
+		if !ok {
+			quality = qualities["*"]
+		}
+		if quality > bestQuality {
+			bestCharset = charset
+			bestQuality = quality
 		}
 	}
 
-	encoding := determineEncoding(req.AcceptEncoding)
+	return bestCharset
+}
 
-	if encoding == "gzip" {
-		responseData = compressGzip(responseData)
-	} else if encoding == "deflate" {
-		responseData = compressDeflate(responseData)
-	} else {
-		encoding = "none"
+func encodeCharset(req HttpRequest, contentType string, data []byte) (string, []byte, bool) {
+	charset := negotiateCharset(req.AcceptCharset)
+	if charset == "" {
+		if strictCharset {
+			return contentType, data, false
+		}
+		charset = "utf-8"
 	}
 
-	response := HttpResponse{
-		Version:         "HTTP/1.1",
-		StatusCode:      "200",
-		ContentType:     contentType,
-		ContentEncoding: encoding,
-		Data:            responseData,
+	switch charset {
+	case "iso-8859-1":
+		data = transcodeUTF8(data, 0xFF)
+	case "us-ascii":
+		data = transcodeUTF8(data, 0x7F)
 	}
 
-	response.ContentLength = len(response.Data)
-	return response
+	return contentType + "; charset=" + charset, data, true
 }
 
-func handle404() HttpResponse {
-	return HttpResponse{
-		Version:    "HTTP/1.1",
-		StatusCode: "404",
+func transcodeUTF8(data []byte, maxRune rune) []byte {
+	transcoded := make([]byte, 0, len(data))
+
+	for _, r := range string(data) {
+		if r > maxRune {
+			r = '?'
+		}
+		transcoded = append(transcoded, byte(r))
 	}
+
+	return transcoded
 }
 
-func determineContentType(accept string) string {
-	accept = strings.ToLower(accept)
+func parseEncodingList(list string) (map[string]bool, error) {
+	enabled := make(map[string]bool)
 
-	if strings.Contains(accept, ",") || strings.Contains(accept, "q=") {
-		return "application/json"
-	}
+	for _, coding := range strings.Split(list, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		known := false
+		for _, supported := range supportedEncodings {
+			if coding == supported {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unsupported encoding %q", coding)
+		}
 
-	if strings.Contains(accept, "application/xml") {
-		return "application/xml"
-	} else if strings.Contains(accept, "application/json") {
-		return "application/json"
+		enabled[coding] = true
 	}
 
-	return "application/json"
+	return enabled, nil
 }
 
-func determineEncoding(acceptEncoding string) string {
-	acceptEncoding = strings.ToLower(acceptEncoding)
+func stripPort(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+	return strings.Trim(host, "[]")
+}
 
-	if strings.Contains(acceptEncoding, ",") || strings.Contains(acceptEncoding, "q=") {
-		return "gzip"
+func isToken(value string) bool {
+	if value == "" {
+		return false
 	}
 
-	if strings.Contains(acceptEncoding, "deflate") {
-		return "deflate"
-	} else if strings.Contains(acceptEncoding, "gzip") {
-		return "gzip"
-	} else if acceptEncoding == "none" {
-		return "none"
+	for _, c := range value {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			continue
+		}
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", c) {
+			return false
+		}
 	}
 
-	return "gzip"
+	return true
 }
 
 func RequestDecoder(bytestream []byte) HttpRequest {
 	requestStr := string(bytestream)
 	lines := strings.Split(requestStr, "\r\n")
 
-	req := HttpRequest{}
+	req := HttpRequest{Headers: HttpHeaders{}}
 
 	if len(lines) > 0 {
 		requestLineParts := strings.Split(lines[0], " ")
@@ -264,7 +2490,14 @@ func RequestDecoder(bytestream []byte) HttpRequest {
 			req.Method = requestLineParts[0]
 			req.Uri = requestLineParts[1]
 			req.Version = requestLineParts[2]
+		} else if len(requestLineParts) == 2 {
+			// "GET /path" with no version is an HTTP/0.9 simple request.
+			req.Method = requestLineParts[0]
+			req.Uri = requestLineParts[1]
+			req.Version = "HTTP/0.9"
 		}
+		// Fragments are client-side only; route on the path without one.
+		req.Uri, _, _ = strings.Cut(req.Uri, "#")
 	}
 
 	for i := 1; i < len(lines); i++ {
@@ -273,29 +2506,139 @@ func RequestDecoder(bytestream []byte) HttpRequest {
 			break
 		}
 
-		headerParts := strings.SplitN(line, ": ", 2)
-		if len(headerParts) == 2 {
-			headerName := strings.ToLower(headerParts[0])
-			headerValue := headerParts[1]
+		if i > MAX_HEADER_COUNT {
+			req.DecodeError = HTTPError{StatusCode: "431", Message: "too many request header fields"}
+			break
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !isToken(name) {
+			if req.DecodeError.StatusCode == "" {
+				req.DecodeError = HTTPError{StatusCode: "400", Message: "malformed request header line"}
+			}
+			continue
+		}
+
+		// Only CRLF ends a line, so a bare CR or LF (or a NUL) would
+		// otherwise survive into the value and could split a header that
+		// echoes it (RFC 9110 section 5.5).
+		if strings.ContainsAny(value, "\r\n\x00") {
+			if req.DecodeError.StatusCode == "" {
+				req.DecodeError = HTTPError{StatusCode: "400", Message: "invalid character in request header value"}
+			}
+			continue
+		}
 
-			switch headerName {
-			case "host":
-				req.Host = headerValue
-			case "accept":
-				req.Accept = headerValue
-			case "accept-encoding":
-				req.AcceptEncoding = headerValue
+		headerName := strings.ToLower(name)
+		headerValue := strings.TrimSpace(value)
+
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		req.Headers[key] = append(req.Headers[key], headerValue)
+
+		switch headerName {
+		case "host":
+			req.Host = headerValue
+		case "authorization":
+			req.Authorization = headerValue
+		case "expect":
+			req.Expect = headerValue
+		case "content-type":
+			req.ContentType = headerValue
+		case "content-length":
+			length, err := strconv.Atoi(headerValue)
+			if err != nil || length < 0 || (len(req.Headers[key]) > 1 && length != req.ContentLength) {
+				req.DecodeError = HTTPError{StatusCode: "400", Message: "invalid Content-Length"}
+				continue
 			}
+			req.ContentLength = length
+		}
+	}
+
+	// List-valued headers may be split across lines; join them per RFC 9110
+	// section 5.3 so negotiation sees every member.
+	req.Accept = strings.Join(req.Headers.Values("Accept"), ", ")
+	req.AcceptEncoding = strings.Join(req.Headers.Values("Accept-Encoding"), ", ")
+	req.AcceptCharset = strings.Join(req.Headers.Values("Accept-Charset"), ", ")
+	req.Connection = strings.Join(req.Headers.Values("Connection"), ", ")
+	req.TransferEncoding = strings.Join(req.Headers.Values("Transfer-Encoding"), ", ")
+	if cookies := req.Headers.Values("Cookie"); len(cookies) > 0 {
+		req.Cookies = parseCookies(strings.Join(cookies, "; "))
+	}
+
+	// Transfer-Encoding overrides Content-Length (RFC 9112 section 6.3), but
+	// a request carrying both is a smuggling vector, so strict mode rejects it.
+	if hasLength := len(req.Headers.Values("Content-Length")) > 0; req.TransferEncoding != "" && req.DecodeError.StatusCode == "" {
+		req.ContentLength = 0
+		if hasLength && strictFraming {
+			req.DecodeError = HTTPError{StatusCode: "400", Message: "request has both Transfer-Encoding and Content-Length"}
+		} else if !isChunked(req) {
+			req.DecodeError = HTTPError{StatusCode: "501", Message: "only the chunked transfer coding is supported"}
+		}
+	}
+
+	if headerEnd := bytes.Index(bytestream, []byte("\r\n\r\n")); headerEnd != -1 {
+		body := bytestream[headerEnd+4:]
+		if isChunked(req) {
+			body, _, _ = dechunk(body)
+		} else if len(body) > req.ContentLength {
+			body = body[:req.ContentLength]
 		}
+		req.Body = body
 	}
 
-	if req.AcceptEncoding == "" {
-		req.AcceptEncoding = "none"
+	// An absent header falls back to the configured default, while an
+	// empty one explicitly asks for identity (RFC 9110 section 12.5.3).
+	if len(req.Headers.Values("Accept-Encoding")) == 0 {
+		req.AcceptEncoding = defaultAcceptEncoding
+	} else if strings.TrimSpace(req.AcceptEncoding) == "" {
+		req.AcceptEncoding = "identity"
 	}
 
 	return req
 }
 
+func compressBody(data []byte, contentType string, encoding string) ([]byte, string) {
+	if !isCompressible(contentType) {
+		return data, "none"
+	}
+
+	var compressed []byte
+
+	switch encoding {
+	case "br":
+		compressed = compressBrotli(data)
+	case "gzip":
+		compressed = compressGzip(data)
+	case "zstd":
+		compressed = compressZstd(data)
+	case "deflate":
+		compressed = compressDeflate(data)
+	default:
+		return data, "none"
+	}
+
+	if len(compressed) == 0 || float64(len(data))/float64(len(compressed)) <= minCompressionRatio {
+		return data, "none"
+	}
+
+	return compressed, encoding
+}
+
+func isCompressible(contentType string) bool {
+	mediaType, _ := parseHeaderParams(strings.ToLower(contentType))
+
+	for _, compressible := range compressibleTypes {
+		if mediaType == compressible {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(compressible, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
 func compressGzip(data []byte) []byte {
 	var buf bytes.Buffer
 	writer := gzip.NewWriter(&buf)
@@ -304,6 +2647,23 @@ func compressGzip(data []byte) []byte {
 	return buf.Bytes()
 }
 
+// gunzipBody decompresses a request body, holding the result to
+// maxBodyBytes so a small upload cannot expand without bound.
+func gunzipBody(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(io.LimitReader(reader, int64(maxBodyBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
 func compressDeflate(data []byte) []byte {
 	var buf bytes.Buffer
 	writer, _ := flate.NewWriter(&buf, 6)
@@ -312,10 +2672,60 @@ func compressDeflate(data []byte) []byte {
 	return buf.Bytes()
 }
 
+func compressZstd(data []byte) []byte {
+	var buf bytes.Buffer
+	writer, _ := zstd.NewWriter(&buf)
+	writer.Write(data)
+	writer.Close()
+	return buf.Bytes()
+}
+
+func compressBrotli(data []byte) []byte {
+	var buf bytes.Buffer
+	writer := brotli.NewWriter(&buf)
+	writer.Write(data)
+	writer.Close()
+	return buf.Bytes()
+}
+
+func reasonPhrase(statusCode string) string {
+	if phrase, ok := reasonPhrases[statusCode]; ok {
+		return phrase
+	}
+	if len(statusCode) == 3 {
+		if phrase, ok := reasonClasses[statusCode[0]]; ok {
+			return phrase
+		}
+	}
+	return "Unknown Status"
+}
+
+// ResponseEncoder writes headers in a fixed order: status line, Date,
+// Server, Content-Type, Content-Encoding, Content-Length (Transfer-Encoding
+// when Chunked, nothing for 204), Connection, any extra headers sorted by
+// name, then one Set-Cookie line per cookie.
 func ResponseEncoder(res HttpResponse) []byte {
+	if res.Version == "HTTP/0.9" {
+		return res.Data
+	}
+
+	response := encodeResponseHead(res)
+	if !res.Chunked {
+		return append(response, res.Data...)
+	}
+
+	for _, chunk := range responseChunks(res) {
+		response = append(response, encodeChunk(chunk)...)
+	}
+	return append(response, "0\r\n\r\n"...)
+}
+
+func encodeResponseHead(res HttpResponse) []byte {
 	var responseBuilder strings.Builder
 
-	responseBuilder.WriteString(fmt.Sprintf("%s %s OK\r\n", res.Version, res.StatusCode))
+	responseBuilder.WriteString(fmt.Sprintf("%s %s %s\r\n", res.Version, res.StatusCode, reasonPhrase(res.StatusCode)))
+	responseBuilder.WriteString(fmt.Sprintf("Date: %s\r\n", timeNow().UTC().Format(http.TimeFormat)))
+	responseBuilder.WriteString(fmt.Sprintf("Server: %s\r\n", SERVER_NAME))
 
 	if res.ContentType != "" {
 		responseBuilder.WriteString(fmt.Sprintf("Content-Type: %s\r\n", res.ContentType))
@@ -325,12 +2735,50 @@ func ResponseEncoder(res HttpResponse) []byte {
 		responseBuilder.WriteString(fmt.Sprintf("Content-Encoding: %s\r\n", res.ContentEncoding))
 	}
 
-	responseBuilder.WriteString(fmt.Sprintf("Content-Length: %d\r\n", res.ContentLength))
+	if res.Chunked {
+		responseBuilder.WriteString("Transfer-Encoding: chunked\r\n")
+	} else if res.StatusCode != "204" {
+		responseBuilder.WriteString(fmt.Sprintf("Content-Length: %d\r\n", res.ContentLength))
+	}
+
+	if res.Connection != "" {
+		responseBuilder.WriteString(fmt.Sprintf("Connection: %s\r\n", res.Connection))
+	}
+
+	headerNames := make([]string, 0, len(res.Headers))
+	for name := range res.Headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	for _, name := range headerNames {
+		responseBuilder.WriteString(fmt.Sprintf("%s: %s\r\n", name, res.Headers[name]))
+	}
+
+	for _, cookie := range res.SetCookies {
+		responseBuilder.WriteString(fmt.Sprintf("Set-Cookie: %s\r\n", cookie))
+	}
 
 	responseBuilder.WriteString("\r\n")
 
-	response := []byte(responseBuilder.String())
-	response = append(response, res.Data...)
+	return []byte(responseBuilder.String())
+}
 
-	return response
+// responseChunks returns res.Chunks, or Data split into BUFFER_SIZE chunks
+// when the handler did not choose its own chunk boundaries.
+func responseChunks(res HttpResponse) [][]byte {
+	if len(res.Chunks) > 0 {
+		return res.Chunks
+	}
+
+	var chunks [][]byte
+	for data := res.Data; len(data) > 0; data = data[min(len(data), BUFFER_SIZE):] {
+		chunks = append(chunks, data[:min(len(data), BUFFER_SIZE)])
+	}
+	return chunks
+}
+
+func encodeChunk(chunk []byte) []byte {
+	encoded := append([]byte(fmt.Sprintf("%x\r\n", len(chunk))), chunk...)
+	return append(encoded, "\r\n"...)
 }
@@ -0,0 +1,2475 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// serveRaw decodes a raw request the way HandleConnection does and serves it.
+func serveRaw(raw string) HttpResponse {
+	return ServeRequest(RequestDecoder([]byte(raw)))
+}
+
+func TestGzipTest(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		encoding       string
+	}{
+		{"gzip", "gzip", "gzip"},
+		{"brotli", "br", "br"},
+		{"identity", "identity", "none"},
+		{"absent", "", "none"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "GET /gzip-test?size=4096 HTTP/1.1\r\nHost: localhost\r\n"
+			if tt.acceptEncoding != "" {
+				raw += "Accept-Encoding: " + tt.acceptEncoding + "\r\n"
+			}
+			res := serveRaw(raw + "\r\n")
+			if res.StatusCode != "200" || res.ContentEncoding != tt.encoding {
+				t.Errorf("got %s with encoding %q, want 200 with %q", res.StatusCode, res.ContentEncoding, tt.encoding)
+			}
+			if vary := res.Headers["Vary"]; vary != "Accept-Charset, Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Charset, Accept-Encoding", vary)
+			}
+		})
+	}
+}
+
+func TestRoot(t *testing.T) {
+	tests := []struct {
+		name        string
+		accept      string
+		rootFile    bool
+		strict      bool
+		status      string
+		contentType string
+		body        string
+	}{
+		{name: "no accept", status: "200", contentType: "text/html; charset=utf-8", body: string(rootHTML)},
+		{name: "browser", accept: "text/html,application/xhtml+xml,*/*;q=0.8", status: "200", contentType: "text/html; charset=utf-8"},
+		{name: "json", accept: "application/json", status: "200", contentType: "application/json; charset=utf-8", body: `{"Message":"` + rootMessage + `"}`},
+		{name: "xml", accept: "application/xml", status: "200", contentType: "application/xml; charset=utf-8", body: "<RootResponse><Message>" + rootMessage + "</Message></RootResponse>"},
+		{name: "html refused", accept: "text/html;q=0, */*", status: "200", contentType: "application/json; charset=utf-8"},
+		{name: "root file ignores json", accept: "application/json", rootFile: true, status: "200", contentType: "text/html; charset=utf-8", body: "<p>custom</p>"},
+		{name: "root file strict", accept: "application/json", rootFile: true, strict: true, status: "406"},
+	}
+
+	defer func(html []byte, fromFile bool, strict bool) {
+		rootHTML, rootFromFile, strictAccept = html, fromFile, strict
+	}(rootHTML, rootFromFile, strictAccept)
+	defaultHTML := rootHTML
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootHTML, rootFromFile, strictAccept = defaultHTML, false, tt.strict
+			if tt.rootFile {
+				rootHTML, rootFromFile = []byte("<p>custom</p>"), true
+			}
+
+			raw := "GET / HTTP/1.1\r\nHost: localhost\r\n"
+			if tt.accept != "" {
+				raw += "Accept: " + tt.accept + "\r\n"
+			}
+			res := serveRaw(raw + "\r\n")
+
+			if res.StatusCode != tt.status {
+				t.Fatalf("StatusCode = %q, want %q", res.StatusCode, tt.status)
+			}
+			if tt.status != "200" {
+				return
+			}
+			if res.ContentType != tt.contentType {
+				t.Errorf("ContentType = %q, want %q", res.ContentType, tt.contentType)
+			}
+			if vary := res.Headers["Vary"]; vary != "Accept, Accept-Charset, Accept-Encoding" {
+				t.Errorf("Vary = %q", vary)
+			}
+			if tt.body != "" && string(res.Data) != tt.body {
+				t.Errorf("Data = %q, want %q", res.Data, tt.body)
+			}
+		})
+	}
+}
+
+func TestHeaderFlagsSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"X-Cdn: edge-1", false},
+		{"Cache-Control: no-store", false},
+		{"X-Cdn", true},
+		{"Bad Name: value", true},
+		{"Content-Length: 0", true},
+		{"transfer-encoding: chunked", true},
+		{"Connection: close", true},
+		{"Date: today", true},
+		{"Server: other", true},
+		{"Content-Type: text/plain", true},
+	}
+
+	for _, tt := range tests {
+		if err := (headerFlags{}).Set(tt.value); (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestInjectedHeaders(t *testing.T) {
+	defer func(headers headerFlags) { injectedHeaders = headers }(injectedHeaders)
+	injectedHeaders = headerFlags{}
+	if err := injectedHeaders.Set("X-Cdn: edge-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, uri := range []string{"/", "/greet/2306216636"} {
+		res := serveRaw("GET " + uri + " HTTP/1.1\r\nHost: localhost\r\n\r\n")
+		if res.Headers["X-Cdn"] != "edge-1" {
+			t.Errorf("%s: X-Cdn = %q, want edge-1", uri, res.Headers["X-Cdn"])
+		}
+	}
+}
+
+func TestStatusTemplates(t *testing.T) {
+	defer func() { statusTemplates = map[string]map[string]statusTemplate{} }()
+
+	if err := RegisterStatusTemplate("404", "text/html", "<p>nothing at {{.Path}}</p>"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterStatusTemplate("404", "application/json", `{"missing":{{json .Path}}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		raw    string
+		status string
+		want   string
+	}{
+		{
+			name:   "custom html escapes the path",
+			raw:    "GET /<script>alert(1)</script> HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status: "404",
+			want:   "<p>nothing at /&lt;script&gt;alert(1)&lt;/script&gt;</p>",
+		},
+		{
+			name:   "custom json",
+			raw:    "GET /a\"b HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\n\r\n",
+			status: "404",
+			want:   `{"missing":"/a\"b"}`,
+		},
+		{
+			name:   "default html for other codes",
+			raw:    "DELETE /health HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status: "405",
+			want:   "<html><body><h1>405 DELETE is not allowed here; allowed methods: GET, HEAD, OPTIONS</h1></body></html>",
+		},
+		{
+			name:   "default json",
+			raw:    "DELETE /health HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\n\r\n",
+			status: "405",
+			want:   `{"status":405,"message":"DELETE is not allowed here; allowed methods: GET, HEAD, OPTIONS"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := serveRaw(tt.raw)
+			if res.StatusCode != tt.status || string(res.Data) != tt.want {
+				t.Errorf("got %s %q, want %s %q", res.StatusCode, res.Data, tt.status, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterStatusTemplateFile(t *testing.T) {
+	defer func() { statusTemplates = map[string]map[string]statusTemplate{} }()
+
+	dir := t.TempDir()
+	page := filepath.Join(dir, "503.html")
+	if err := os.WriteFile(page, []byte("<p>{{.StatusCode}} down</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"503=" + page, false},
+		{"503", true},
+		{"abc=" + page, true},
+		{"503=" + filepath.Join(dir, "page.txt"), true},
+		{"503=" + filepath.Join(dir, "missing.html"), true},
+	}
+
+	for _, tt := range tests {
+		if err := registerStatusTemplateFile(tt.value); (err != nil) != tt.wantErr {
+			t.Errorf("registerStatusTemplateFile(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+		}
+	}
+
+	res := errorResponse(HttpRequest{}, HTTPError{StatusCode: "503"})
+	if string(res.Data) != "<p>503 down</p>" {
+		t.Errorf("Data = %q", res.Data)
+	}
+}
+
+func TestDefaultStatusBodyJSON(t *testing.T) {
+	message := "bad \"quote\" \x01 and </script>"
+	var decoded StatusBody
+	if err := json.Unmarshal(defaultStatusBody("application/json", StatusPage{StatusCode: "400", Message: message}), &decoded); err != nil {
+		t.Fatalf("default JSON body does not parse: %v", err)
+	}
+	if decoded.Status != 400 || decoded.Message != message {
+		t.Errorf("decoded = %+v", decoded)
+	}
+}
+
+func TestAdminConfig(t *testing.T) {
+	defer func(token string, body int, rate int, proxies []*net.IPNet) {
+		adminToken, maxBodyBytes, responseRate, trustedProxies = token, body, rate, proxies
+	}(adminToken, maxBodyBytes, responseRate, trustedProxies)
+
+	if res := serveRaw("GET /admin/config HTTP/1.1\r\nHost: localhost\r\nAuthorization: Bearer \r\n\r\n"); res.StatusCode != "404" {
+		t.Errorf("without -admin-token: StatusCode = %q, want 404", res.StatusCode)
+	}
+
+	adminToken = "s3cret"
+	maxBodyBytes = 4096
+	responseRate = 2048
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies = []*net.IPNet{network}
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        string
+	}{
+		{"missing token", "", "401"},
+		{"wrong token", "Bearer nope", "401"},
+		{"valid token", "Bearer s3cret", "200"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "GET /admin/config HTTP/1.1\r\nHost: localhost\r\n"
+			if tt.authorization != "" {
+				raw += "Authorization: " + tt.authorization + "\r\n"
+			}
+			res := serveRaw(raw + "\r\n")
+			if res.StatusCode != tt.status {
+				t.Fatalf("StatusCode = %q, want %q", res.StatusCode, tt.status)
+			}
+			if tt.status != "200" {
+				return
+			}
+
+			if bytes.Contains(res.Data, []byte("s3cret")) {
+				t.Errorf("config leaks the admin token: %s", res.Data)
+			}
+
+			var config ServerConfig
+			if err := json.Unmarshal(res.Data, &config); err != nil {
+				t.Fatal(err)
+			}
+			if config.MaxBodyBytes != 4096 || config.KeepAliveTimeout != keepAliveTimeout.String() || !config.StrictFraming {
+				t.Errorf("config = %+v", config)
+			}
+			if config.ResponseRate != 2048 || config.ChunkedThreshold != chunkedThreshold || config.ShutdownTimeout != shutdownTimeout.String() {
+				t.Errorf("config = %+v", config)
+			}
+			if config.DefaultAcceptEncoding != defaultAcceptEncoding || config.JSONEscapeHTML != jsonEscapeHTML {
+				t.Errorf("config = %+v", config)
+			}
+			if len(config.TrustedProxies) != 1 || config.TrustedProxies[0] != "10.0.0.0/8" {
+				t.Errorf("TrustedProxies = %v", config.TrustedProxies)
+			}
+			if len(config.CompressibleTypes) != len(compressibleTypes) {
+				t.Errorf("CompressibleTypes = %v, want %v", config.CompressibleTypes, compressibleTypes)
+			}
+		})
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "s3cret"
+	defer setRouteEnabled("/greet", true)
+
+	admin := func(method string, query string) HttpResponse {
+		return serveRaw(method + " /admin/routes" + query + " HTTP/1.1\r\nHost: localhost\r\nAuthorization: Bearer s3cret\r\n\r\n")
+	}
+	status := func(uri string) string {
+		return serveRaw("GET " + uri + " HTTP/1.1\r\nHost: localhost\r\n\r\n").StatusCode
+	}
+
+	if res := admin("GET", "?route=/greet&enabled=false"); res.StatusCode != "200" || string(res.Data) != `{"disabled_routes":[]}` {
+		t.Fatalf("GET changed state: %s %s", res.StatusCode, res.Data)
+	}
+	if got := status("/greet/2306216636"); got != "200" {
+		t.Fatalf("/greet after GET = %s, want 200", got)
+	}
+
+	if res := admin("POST", "?route=/greet&enabled=false"); res.StatusCode != "200" || string(res.Data) != `{"disabled_routes":["/greet"]}` {
+		t.Fatalf("POST disable = %s %s", res.StatusCode, res.Data)
+	}
+	if got := status("/greet/2306216636"); got != "503" {
+		t.Errorf("/greet while disabled = %s, want 503", got)
+	}
+	if got := status("/health"); got != "200" {
+		t.Errorf("/health while /greet is disabled = %s, want 200", got)
+	}
+
+	if res := admin("POST", "?route=/admin/config&enabled=false"); res.StatusCode != "400" {
+		t.Errorf("disabling an admin route = %s, want 400", res.StatusCode)
+	}
+	if res := admin("POST", "?route=/greet&enabled=maybe"); res.StatusCode != "400" {
+		t.Errorf("invalid enabled = %s, want 400", res.StatusCode)
+	}
+
+	if res := admin("POST", "?route=/health/&enabled=false"); string(res.Data) != `{"disabled_routes":["/greet","/health"]}` {
+		t.Errorf("disabling /health/ = %s", res.Data)
+	}
+	for _, uri := range []string{"/health", "/health/", "/greet/2306216636/"} {
+		if got := status(uri); got != "503" {
+			t.Errorf("%s while disabled = %s, want 503", uri, got)
+		}
+	}
+	admin("POST", "?route=/health&enabled=true")
+
+	admin("POST", "?route=/greet&enabled=true")
+	if got := status("/greet/2306216636"); got != "200" {
+		t.Errorf("/greet after re-enabling = %s, want 200", got)
+	}
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	offered := []string{"application/json", "application/xml"}
+
+	tests := []struct {
+		accept string
+		strict bool
+		want   string
+	}{
+		{"", false, "application/json"},
+		{"application/xml", false, "application/xml"},
+		{"*/*", false, "application/json"},
+		{"application/*", false, "application/json"},
+		{"application/xml, application/json;q=0.9", false, "application/xml"},
+		{"application/json;q=0, */*", false, "application/xml"},
+		{"*/*;q=0.9, application/json;q=0.1", false, "application/xml"},
+		{"application/*;q=0.2, application/xml;q=0.1", false, "application/json"},
+		{"application/json;q=0, application/*;q=0.5", false, "application/xml"},
+		{"APPLICATION/XML", false, "application/xml"},
+		{"text/html", false, "application/json"},
+		{"text/html", true, ""},
+		{"application/json;q=0", false, "application/xml"},
+		{"application/json;q=0", true, ""},
+		{"application/json;q=0, application/xml;q=0", false, ""},
+		{"*/*;q=0", false, ""},
+		{"application/xml;q=bogus, application/json", false, "application/json"},
+	}
+
+	defer func(strict bool) { strictAccept = strict }(strictAccept)
+	for _, tt := range tests {
+		strictAccept = tt.strict
+		if got := negotiateContentType(tt.accept, offered); got != tt.want {
+			t.Errorf("negotiateContentType(%q) strict=%v = %q, want %q", tt.accept, tt.strict, got, tt.want)
+		}
+	}
+}
+
+func TestChunkDecoderIncremental(t *testing.T) {
+	data := []byte("4\r\nHalo\r\n2;x=1\r\n, \r\n6\r\ndunia!\r\n0\r\nX-Checksum: 1\r\n\r\nnext")
+
+	var decoder chunkDecoder
+	for n := 0; n <= len(data); n++ {
+		done, err := decoder.advance(data[:n])
+		if err != nil {
+			t.Fatalf("advance(%d bytes) error = %v", n, err)
+		}
+		if done {
+			if string(decoder.body) != "Halo, dunia!" || string(data[decoder.offset:n]) != "" {
+				t.Fatalf("advance(%d bytes) = %q, rest %q", n, decoder.body, data[decoder.offset:n])
+			}
+			if n != len(data)-len("next") {
+				t.Errorf("finished after %d bytes, want %d", n, len(data)-len("next"))
+			}
+			return
+		}
+	}
+	t.Fatal("decoder never finished")
+}
+
+func TestReadRequestContinue(t *testing.T) {
+	defer func(body int) { maxBodyBytes = body }(maxBodyBytes)
+	maxBodyBytes = 16
+
+	tests := []struct {
+		name         string
+		head         string
+		body         string
+		wantContinue bool
+		status       string
+	}{
+		{
+			name:         "content-length",
+			head:         "POST /echo HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n",
+			body:         "hello",
+			wantContinue: true,
+		},
+		{
+			name:         "chunked",
+			head:         "POST /echo HTTP/1.1\r\nExpect: 100-continue\r\nTransfer-Encoding: chunked\r\n\r\n",
+			body:         "5\r\nhello\r\n0\r\n\r\n",
+			wantContinue: true,
+		},
+		{
+			name:   "over the body cap",
+			head:   "POST /echo HTTP/1.1\r\nExpect: 100-continue\r\nContent-Length: 17\r\n\r\n",
+			status: "413",
+		},
+		{
+			name: "http/1.0 gets no interim response",
+			head: "POST /echo HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n",
+			body: "hello",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			interim := make(chan string, 1)
+			go func() {
+				clientConn.Write([]byte(tt.head))
+				if tt.wantContinue {
+					buffer := make([]byte, BUFFER_SIZE)
+					n, _ := clientConn.Read(buffer)
+					interim <- string(buffer[:n])
+				}
+				clientConn.Write([]byte(tt.body))
+			}()
+
+			req, _, err := readRequest(serverConn, nil)
+			if err != nil {
+				t.Fatalf("readRequest() error = %v", err)
+			}
+			if req.DecodeError.StatusCode != tt.status {
+				t.Fatalf("DecodeError = %v, want status %q", req.DecodeError, tt.status)
+			}
+			if tt.wantContinue {
+				if got := <-interim; got != "HTTP/1.1 100 Continue\r\n\r\n" {
+					t.Errorf("interim response = %q", got)
+				}
+			}
+			if tt.status == "" && string(req.Body) != "hello" {
+				t.Errorf("Body = %q, want hello", req.Body)
+			}
+		})
+	}
+}
+
+func TestExpectContinueEndToEnd(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 3*BUFFER_SIZE/10+7)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go HandleConnection(context.Background(), serverConn)
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	head := "POST /echo HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nConnection: close\r\n" +
+		"Content-Type: text/plain\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n"
+	if _, err := clientConn.Write([]byte(head)); err != nil {
+		t.Fatal(err)
+	}
+
+	buffer := make([]byte, BUFFER_SIZE)
+	n, err := clientConn.Read(buffer)
+	if err != nil || string(buffer[:n]) != "HTTP/1.1 100 Continue\r\n\r\n" {
+		t.Fatalf("interim response = %q, %v", buffer[:n], err)
+	}
+
+	go clientConn.Write(body)
+	response, _ := io.ReadAll(clientConn)
+
+	if !bytes.HasPrefix(response, []byte("HTTP/1.1 200 OK\r\n")) || !bytes.HasSuffix(response, body) {
+		t.Fatalf("final response does not echo the %d byte body: %.200q", len(body), response)
+	}
+}
+
+func TestExpectContinueOverLimit(t *testing.T) {
+	defer func(body int) { maxBodyBytes = body }(maxBodyBytes)
+	maxBodyBytes = 1024
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go HandleConnection(context.Background(), serverConn)
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go clientConn.Write([]byte("POST /echo HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 4096\r\n\r\n"))
+	response, _ := io.ReadAll(clientConn)
+
+	if !bytes.HasPrefix(response, []byte("HTTP/1.1 413 ")) {
+		t.Errorf("response = %.200q, want 413 with no interim response", response)
+	}
+}
+
+func TestAccessLogBodySizes(t *testing.T) {
+	logged := captureAccessLog(t)
+
+	serveConn(t, "POST /echo HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nContent-Length: 11\r\n\r\nhello world")
+
+	want := `pipe "POST /echo HTTP/1.1" 200 request_bytes=11 response_bytes=11 conn_request=1` + "\n" +
+		"pipe connection closed after 1 requests\n"
+	if logged.String() != want {
+		t.Errorf("access log = %q, want %q", logged.String(), want)
+	}
+}
+
+func TestIdleKeepAliveIsClosed(t *testing.T) {
+	defer func(idle time.Duration) { keepAliveTimeout = idle }(keepAliveTimeout)
+	keepAliveTimeout = 50 * time.Millisecond
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		HandleConnection(context.Background(), serverConn)
+		close(done)
+	}()
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go clientConn.Write([]byte("GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	start := time.Now()
+	response, _ := io.ReadAll(clientConn)
+	<-done
+
+	if !bytes.Contains(response, []byte("Connection: keep-alive")) {
+		t.Fatalf("response = %q, want a keep-alive response", response)
+	}
+	if elapsed := time.Since(start); elapsed < keepAliveTimeout || elapsed > 2*time.Second {
+		t.Errorf("idle connection closed after %v, want about %v", elapsed, keepAliveTimeout)
+	}
+	if active := activeConns.Load(); active != 0 {
+		t.Errorf("activeConns = %d after the reap, want 0", active)
+	}
+}
+
+func TestSlowUpload(t *testing.T) {
+	defer func(idle, read time.Duration) { keepAliveTimeout, readTimeout = idle, read }(keepAliveTimeout, readTimeout)
+	keepAliveTimeout = 50 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		readTimeout time.Duration
+		status      string
+	}{
+		{"bytes keep arriving", time.Second, "200"},
+		{"stalled past the read timeout", 20 * time.Millisecond, "408"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readTimeout = tt.readTimeout
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			go HandleConnection(context.Background(), serverConn)
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			go func() {
+				clientConn.Write([]byte("POST /echo HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nContent-Length: 5\r\n\r\n"))
+				for _, b := range []byte("hello") {
+					time.Sleep(30 * time.Millisecond)
+					if _, err := clientConn.Write([]byte{b}); err != nil {
+						return
+					}
+				}
+			}()
+
+			response, _ := io.ReadAll(clientConn)
+			if want := "HTTP/1.1 " + tt.status + " "; !bytes.HasPrefix(response, []byte(want)) {
+				t.Errorf("response = %.100q, want %s", response, want)
+			}
+		})
+	}
+}
+
+func TestAccessLogConnectionRequests(t *testing.T) {
+	logged := captureAccessLog(t)
+
+	serveConn(t, "GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /missing HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+
+	lines := strings.Split(strings.TrimSuffix(logged.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("access log has %d lines, want 3:\n%s", len(lines), logged)
+	}
+	for i, suffix := range []string{" 200 request_bytes=0 response_bytes=", " 404 request_bytes=0 response_bytes=", "connection closed after 2 requests"} {
+		if !strings.Contains(lines[i], suffix) {
+			t.Errorf("line %d = %q, want it to contain %q", i+1, lines[i], suffix)
+		}
+	}
+	for i, want := range []string{" conn_request=1", " conn_request=2"} {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Errorf("line %d = %q, want it to end in %q", i+1, lines[i], want)
+		}
+	}
+}
+
+func BenchmarkReadRequest(b *testing.B) {
+	for _, size := range []int{4 * 1024, 64 * 1024, MAX_BODY_BYTES} {
+		request := append([]byte("POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: "+strconv.Itoa(size)+"\r\n\r\n"), bytes.Repeat([]byte("a"), size)...)
+
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(request)))
+			for i := 0; i < b.N; i++ {
+				req, _, err := readRequest(&readerConn{Reader: bytes.NewReader(request)}, nil)
+				if err != nil || len(req.Body) != size {
+					b.Fatalf("readRequest() = %d bytes, %v", len(req.Body), err)
+				}
+			}
+		})
+	}
+}
+
+// readerConn is a net.Conn that only supports Read, serving it from Reader.
+type readerConn struct {
+	net.Conn
+	*bytes.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+func TestServeClosesConnectionsAfterShutdownTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { shutdownTimeout = timeout }(shutdownTimeout)
+	shutdownTimeout = 100 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		Serve(ctx, listener)
+		close(stopped)
+	}()
+
+	// A request that never finishes keeps its connection busy past the
+	// shutdown timeout.
+	connection, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	connection.Write([]byte("GET /health HTTP/1.1\r\n"))
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the shutdown timeout")
+	}
+	if elapsed := time.Since(start); elapsed < shutdownTimeout {
+		t.Errorf("Serve returned after %v, before the %v shutdown timeout", elapsed, shutdownTimeout)
+	}
+
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := connection.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() error = %v, want EOF from a closed connection", err)
+	}
+}
+
+func TestShutdownInterruptsIdleKeepAlive(t *testing.T) {
+	defer func(timeout time.Duration) { shutdownTimeout = timeout }(shutdownTimeout)
+	defer func(idle time.Duration) { keepAliveTimeout = idle }(keepAliveTimeout)
+	shutdownTimeout = 5 * time.Second
+	keepAliveTimeout = 10 * time.Second
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		Serve(ctx, listener)
+		close(stopped)
+	}()
+
+	connection, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	connection.Write([]byte("GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	reader := bufio.NewReader(connection)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	if res.Close {
+		t.Fatal("first response closed the connection, want keep-alive")
+	}
+
+	// The connection now sits idle waiting for a second request; shutdown
+	// must release it well before either timeout.
+	start := time.Now()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Serve waited on an idle keep-alive connection instead of closing it")
+	}
+	if elapsed := time.Since(start); elapsed >= shutdownTimeout {
+		t.Errorf("Serve returned after %v, want the idle connection closed before the shutdown timeout", elapsed)
+	}
+
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("ReadByte() error = %v, want EOF from a closed connection", err)
+	}
+}
+
+func TestShutdownForcesSlowHandler(t *testing.T) {
+	defer func(timeout time.Duration) { shutdownTimeout = timeout }(shutdownTimeout)
+	shutdownTimeout = 100 * time.Millisecond
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	defer func(routes []route) { router.routes = routes }(router.routes)
+	router.Handle("GET", "/slow", func(req HttpRequest) HttpResponse {
+		close(started)
+		<-release
+		return handleHealth(req)
+	})
+	defer close(release)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		Serve(ctx, listener)
+		close(stopped)
+	}()
+
+	connection, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	connection.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	<-started
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve waited for the slow handler instead of forcing its connection closed")
+	}
+
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	response, err := io.ReadAll(connection)
+	if err != nil || len(response) != 0 {
+		t.Errorf("got %q, %v; want the connection closed without a response", response, err)
+	}
+}
+
+func TestEchoHeaders(t *testing.T) {
+	head := "GET /echo/headers HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"x-lower-case: kept as sent\r\n" +
+		"X-Spaced:   padded value  \r\n" +
+		"X-Repeated: 1\r\n" +
+		"X-Repeated: 2\r\n" +
+		"Connection: close\r\n" +
+		"\r\n"
+
+	_, body, _ := strings.Cut(serveConn(t, head), "\r\n\r\n")
+	if want := strings.TrimSuffix(head, "\r\n\r\n"); body != want {
+		t.Errorf("body = %q, want the header block %q", body, want)
+	}
+}
+
+func TestZstdRoundTrip(t *testing.T) {
+	plain := serveRaw("GET /gzip-test?size=4096 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	res := serveRaw("GET /gzip-test?size=4096 HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: zstd\r\n\r\n")
+	if res.ContentEncoding != "zstd" {
+		t.Fatalf("ContentEncoding = %q, want zstd", res.ContentEncoding)
+	}
+
+	reader, err := zstd.NewReader(bytes.NewReader(res.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, plain.Data) {
+		t.Errorf("zstd body decodes to %d bytes that differ from the %d byte identity body", len(decoded), len(plain.Data))
+	}
+}
+
+func TestNegotiateEncodingDisabled(t *testing.T) {
+	defer func(enabled map[string]bool) { enabledEncodings = enabled }(enabledEncodings)
+	enabledEncodings = map[string]bool{"gzip": true}
+
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"deflate, gzip;q=0.5", "gzip"},
+		{"deflate", "none"},
+		{"br, deflate, *;q=0.1", "gzip"},
+		{"deflate, identity;q=0", ""},
+	}
+
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.acceptEncoding); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) with only gzip enabled = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestConnectionHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"http/1.1 default", "GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n", "keep-alive"},
+		{"http/1.1 close", "GET /health HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", "close"},
+		{"http/1.0 default", "GET /health HTTP/1.0\r\n\r\n", "close"},
+		{"http/1.0 keep-alive", "GET /health HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", "keep-alive"},
+		{"server error closes", "GET /health HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip\r\n\r\n", "close"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serveRaw(tt.raw).Connection; got != tt.want {
+				t.Errorf("Connection = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerForcesClose(t *testing.T) {
+	defer func(routes []route) { router.routes = routes }(router.routes)
+	router.Handle("GET", "/fail", func(req HttpRequest) HttpResponse {
+		response := errorResponse(req, HTTPError{StatusCode: "500"})
+		response.Connection = "close"
+		return response
+	})
+
+	// The second request is pipelined behind the failing one; the server
+	// must close the socket instead of answering it.
+	response := serveConn(t, "GET /fail HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	if !strings.HasPrefix(response, "HTTP/1.1 500 ") || !strings.Contains(response, "\r\nConnection: close\r\n") {
+		t.Fatalf("response = %q, want 500 with Connection: close", response)
+	}
+	if got := strings.Count(response, "HTTP/1.1 "); got != 1 {
+		t.Errorf("got %d responses, want the socket closed after the first:\n%s", got, response)
+	}
+}
+
+func TestInvalidMethod(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"empty method", " /health HTTP/1.1\r\nHost: localhost\r\n\r\n"},
+		{"separator in method", "GE(T /health HTTP/1.1\r\nHost: localhost\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			response := serveConn(t, tt.raw)
+
+			if !strings.HasPrefix(response, "HTTP/1.1 400 ") || !strings.Contains(response, "\r\nConnection: close\r\n") {
+				t.Errorf("response = %q, want 400 with Connection: close", response)
+			}
+			if elapsed := time.Since(start); elapsed >= keepAliveTimeout {
+				t.Errorf("connection held open for %v after the 400", elapsed)
+			}
+		})
+	}
+}
+
+func TestQuotedHeaderValues(t *testing.T) {
+	req := RequestDecoder([]byte("GET / HTTP/1.1\r\n" +
+		"Cookie: a=1; b=\"two; three\"; c=\"say \\\"hi\\\"\"\r\n" +
+		"Accept: text/html;level=\"1,2\";q=0.5, application/json\r\n" +
+		"\r\n"))
+
+	if req.Cookies["a"] != "1" || req.Cookies["b"] != "two; three" || req.Cookies["c"] != `say "hi"` {
+		t.Errorf("Cookies = %v", req.Cookies)
+	}
+
+	elements := splitHeaderValue(req.Accept, ',')
+	if len(elements) != 2 {
+		t.Fatalf("Accept elements = %q, want 2", elements)
+	}
+	mediaType, params := parseHeaderParams(elements[0])
+	if mediaType != "text/html" || params["level"] != "1,2" || params["q"] != "0.5" {
+		t.Errorf("parseHeaderParams(%q) = %q, %v", elements[0], mediaType, params)
+	}
+}
+
+func TestUnsupportedExpectation(t *testing.T) {
+	res := serveRaw("POST /echo HTTP/1.1\r\nHost: localhost\r\nExpect: 200-ok\r\nContent-Length: 5\r\n\r\nhello")
+	if res.StatusCode != "417" || res.Connection != "close" {
+		t.Errorf("got %s with Connection %q, want 417 with close", res.StatusCode, res.Connection)
+	}
+}
+
+func TestCompressionRatioGuard(t *testing.T) {
+	defer func(ratio float64) { minCompressionRatio = ratio }(minCompressionRatio)
+	data := bytes.Repeat([]byte("Halo, dunia! "), 100)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		ratio    float64
+		encoding string
+	}{
+		{"compressible body", data, 1.0, "gzip"},
+		{"tiny body grows when compressed", []byte("a"), 1.0, "none"},
+		{"ratio above what gzip reaches", data, 1000, "none"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			minCompressionRatio = tt.ratio
+			body, encoding := compressBody(tt.data, "text/plain", "gzip")
+			if encoding != tt.encoding {
+				t.Errorf("encoding = %q, want %q", encoding, tt.encoding)
+			}
+			if encoding == "none" && !bytes.Equal(body, tt.data) {
+				t.Errorf("identity fallback changed the body")
+			}
+		})
+	}
+}
+
+func TestStream(t *testing.T) {
+	res := serveRaw("GET /stream?count=3 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if res.StatusCode != "200" || res.ContentType != "application/x-ndjson" || !res.Chunked {
+		t.Fatalf("got %s %q chunked=%v, want a chunked 200 application/x-ndjson", res.StatusCode, res.ContentType, res.Chunked)
+	}
+	if len(res.Chunks) != 3 {
+		t.Fatalf("got %d chunks, want one per object", len(res.Chunks))
+	}
+	for i, chunk := range res.Chunks {
+		var event StreamEvent
+		line, ok := bytes.CutSuffix(chunk, []byte("\n"))
+		if !ok || bytes.Contains(line, []byte("\n")) || json.Unmarshal(line, &event) != nil || event.Seq != i+1 {
+			t.Errorf("chunk %d = %q, want one JSON line with seq %d", i, chunk, i+1)
+		}
+	}
+
+	res = serveRaw("GET /stream?count=3 HTTP/1.0\r\n\r\n")
+	if res.Chunked || bytes.Count(res.Data, []byte("\n")) != 3 {
+		t.Errorf("HTTP/1.0 got chunked=%v body %q, want three lines in a plain body", res.Chunked, res.Data)
+	}
+}
+
+func TestSlowStream(t *testing.T) {
+	delay := 30 * time.Millisecond
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go HandleConnection(context.Background(), serverConn)
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	go clientConn.Write([]byte("GET /slow-stream?count=3&delay=" + delay.String() + " HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+
+	var response []byte
+	var firstChunk time.Time
+	buffer := make([]byte, BUFFER_SIZE)
+	for {
+		n, err := clientConn.Read(buffer)
+		response = append(response, buffer[:n]...)
+		if firstChunk.IsZero() && bytes.Contains(response, []byte("chunk 1 of 3")) {
+			firstChunk = time.Now()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	if elapsed := time.Since(firstChunk); firstChunk.IsZero() || elapsed < 2*delay {
+		t.Errorf("the last chunk arrived %v after the first, want at least %v", elapsed, 2*delay)
+	}
+
+	_, body, _ := bytes.Cut(response, []byte("\r\n\r\n"))
+	decoded, _, err := dechunk(body)
+	if want := "chunk 1 of 3\nchunk 2 of 3\nchunk 3 of 3\n"; err != nil || string(decoded) != want {
+		t.Errorf("dechunk() = %q, %v, want %q", decoded, err, want)
+	}
+}
+
+func TestSlowStreamLimits(t *testing.T) {
+	for _, query := range []string{"count=0", "delay=-1s", "delay=soon", "count=100&delay=1s"} {
+		if res := serveRaw("GET /slow-stream?" + query + " HTTP/1.1\r\nHost: localhost\r\n\r\n"); res.StatusCode != "400" {
+			t.Errorf("%s: StatusCode = %q, want 400", query, res.StatusCode)
+		}
+	}
+}
+
+func TestHeaderBoundary(t *testing.T) {
+	defer func(allow bool) { allowHTTP09 = allow }(allowHTTP09)
+
+	tests := []struct {
+		name      string
+		data      string
+		http09    bool
+		headerEnd int
+		bodyStart int
+	}{
+		{"complete head", "GET / HTTP/1.1\r\nHost: x\r\n\r\nbody", false, 23, 27},
+		{"head still arriving", "GET / HTTP/1.1\r\n", true, -1, -1},
+		{"empty method still arriving", " /x HTTP/1.1\r\n", true, -1, -1},
+		{"simple request disabled", "GET /x\r\n", false, -1, -1},
+		{"simple request enabled", "GET /x\r\n", true, 6, 8},
+		{"simple request needs GET", "POST /x\r\n", true, -1, -1},
+		{"double space is not simple", "GET  /x\r\n", true, -1, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowHTTP09 = tt.http09
+			headerEnd, bodyStart := headerBoundary([]byte(tt.data))
+			if headerEnd != tt.headerEnd || bodyStart != tt.bodyStart {
+				t.Errorf("headerBoundary(%q) = %d, %d, want %d, %d", tt.data, headerEnd, bodyStart, tt.headerEnd, tt.bodyStart)
+			}
+		})
+	}
+}
+
+func TestSimpleRequest(t *testing.T) {
+	defer func(allow bool) { allowHTTP09 = allow }(allowHTTP09)
+
+	allowHTTP09 = false
+	if res := serveRaw("GET /health\r\n"); res.StatusCode != "400" || res.Connection != "close" {
+		t.Errorf("disabled: got %s with Connection %q, want 400 with close", res.StatusCode, res.Connection)
+	}
+
+	allowHTTP09 = true
+	response := serveConn(t, "GET /health\r\n")
+	var health HealthResponse
+	if err := json.Unmarshal([]byte(response), &health); err != nil || health.Status != "ok" {
+		t.Errorf("enabled: response = %q, want the bare /health body", response)
+	}
+}
+
+func TestReadRequestLimits(t *testing.T) {
+	defer func(header, body int) { maxHeaderBytes, maxBodyBytes = header, body }(maxHeaderBytes, maxBodyBytes)
+	maxHeaderBytes = 64
+	maxBodyBytes = 8
+
+	tests := []struct {
+		name   string
+		raw    string
+		status string
+	}{
+		{"header too large", "GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", 100) + "\r\n\r\n", "431"},
+		{"content-length too large", "POST /echo HTTP/1.1\r\nContent-Length: 9\r\n\r\n", "413"},
+		{"chunks too large in one read", "POST /echo HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nabcde\r\n5\r\nfghij\r\n0\r\n\r\n", "413"},
+		{"single chunk too large", "POST /echo HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n9\r\n", "413"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _, err := readRequest(rawConn(t, tt.raw), nil)
+			if err != nil {
+				t.Fatalf("readRequest() error = %v", err)
+			}
+			if req.DecodeError.StatusCode != tt.status {
+				t.Errorf("DecodeError = %v, want status %q", req.DecodeError, tt.status)
+			}
+		})
+	}
+}
+
+func TestResponseEncoder(t *testing.T) {
+	defer func(now func() time.Time) { timeNow = now }(timeNow)
+	timeNow = func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	tests := []struct {
+		name string
+		res  HttpResponse
+		want string
+	}{
+		{
+			name: "content-length",
+			res: HttpResponse{
+				Version:       "HTTP/1.1",
+				StatusCode:    "200",
+				ContentType:   "text/plain",
+				ContentLength: 5,
+				Connection:    "close",
+				Headers:       map[string]string{"Vary": "Accept", "Allow": "GET"},
+				SetCookies:    []string{"a=1"},
+				Data:          []byte("hello"),
+			},
+			want: "HTTP/1.1 200 OK\r\n" +
+				"Date: Tue, 02 Jan 2024 03:04:05 GMT\r\n" +
+				"Server: jarkom-A3/1.0\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"Content-Length: 5\r\n" +
+				"Connection: close\r\n" +
+				"Allow: GET\r\n" +
+				"Vary: Accept\r\n" +
+				"Set-Cookie: a=1\r\n" +
+				"\r\n" +
+				"hello",
+		},
+		{
+			name: "chunked",
+			res: HttpResponse{
+				Version:         "HTTP/1.1",
+				StatusCode:      "200",
+				ContentEncoding: "gzip",
+				Chunked:         true,
+				Chunks:          [][]byte{[]byte("ab"), []byte("cde")},
+			},
+			want: "HTTP/1.1 200 OK\r\n" +
+				"Date: Tue, 02 Jan 2024 03:04:05 GMT\r\n" +
+				"Server: jarkom-A3/1.0\r\n" +
+				"Content-Encoding: gzip\r\n" +
+				"Transfer-Encoding: chunked\r\n" +
+				"\r\n" +
+				"2\r\nab\r\n3\r\ncde\r\n0\r\n\r\n",
+		},
+		{
+			name: "no content",
+			res:  HttpResponse{Version: "HTTP/1.1", StatusCode: "204"},
+			want: "HTTP/1.1 204 No Content\r\n" +
+				"Date: Tue, 02 Jan 2024 03:04:05 GMT\r\n" +
+				"Server: jarkom-A3/1.0\r\n" +
+				"\r\n",
+		},
+		{
+			name: "http/0.9",
+			res:  HttpResponse{Version: "HTTP/0.9", StatusCode: "200", Data: []byte("bare")},
+			want: "bare",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ResponseEncoder(tt.res); string(got) != tt.want {
+				t.Errorf("ResponseEncoder() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	defer func(hosts map[string]bool) { allowedHosts = hosts }(allowedHosts)
+	allowedHosts = map[string]bool{"example.com": true}
+
+	tests := []struct {
+		host   string
+		status string
+	}{
+		{"example.com", "200"},
+		{"EXAMPLE.com:6636", "200"},
+		{"other.com", "421"},
+	}
+
+	for _, tt := range tests {
+		res := serveRaw("GET /health HTTP/1.1\r\nHost: " + tt.host + "\r\n\r\n")
+		if res.StatusCode != tt.status {
+			t.Errorf("Host %q: StatusCode = %q, want %q", tt.host, res.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestServeRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		status      string
+		contentType string
+		headers     map[string]string
+		body        string
+	}{
+		{
+			name:        "echo",
+			raw:         "POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello",
+			status:      "200",
+			contentType: "text/plain",
+			body:        "hello",
+		},
+		{
+			name:        "greet json",
+			raw:         "GET /greet/2306216636 HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\n\r\n",
+			status:      "200",
+			contentType: "application/json; charset=utf-8",
+			headers:     map[string]string{"Vary": "Accept, Accept-Charset, Accept-Encoding"},
+			body:        `{"Student":{"Nama":"Muhammad Raihan Maulana","Npm":"2306216636"},"Greeter":"Muhammad Raihan Maulana"}`,
+		},
+		{
+			name:        "greet xml with name",
+			raw:         "GET /greet/2306216636?name=Budi HTTP/1.1\r\nHost: localhost\r\nAccept: application/xml\r\n\r\n",
+			status:      "200",
+			contentType: "application/xml; charset=utf-8",
+			body:        "<GreetResponse><Student><Nama>Muhammad Raihan Maulana</Nama><Npm>2306216636</Npm></Student><Greeter>Budi</Greeter></GreetResponse>",
+		},
+		{
+			name:   "connect",
+			raw:    "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+			status: "501",
+		},
+		{
+			name:   "greet with fragment",
+			raw:    "GET /greet/2306216636#section HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status: "200",
+		},
+		{
+			name:    "post to a get-only route",
+			raw:     "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n",
+			status:  "405",
+			headers: map[string]string{"Allow": "GET, HEAD, OPTIONS"},
+		},
+		{
+			name:   "head has no body",
+			raw:    "HEAD /echo HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status: "200",
+		},
+		{
+			name:    "options",
+			raw:     "OPTIONS /health HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status:  "204",
+			headers: map[string]string{"Allow": "GET, HEAD, OPTIONS"},
+		},
+		{
+			name:    "options root",
+			raw:     "OPTIONS / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status:  "204",
+			headers: map[string]string{"Allow": "GET, HEAD, OPTIONS"},
+		},
+		{
+			name:    "options greet",
+			raw:     "OPTIONS /greet/2306216636 HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status:  "204",
+			headers: map[string]string{"Allow": "GET, HEAD, OPTIONS"},
+		},
+		{
+			name:   "options unknown path",
+			raw:    "OPTIONS /missing HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status: "404",
+		},
+		{
+			name:   "options asterisk",
+			raw:    "OPTIONS * HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status: "204",
+		},
+		{
+			name:   "asterisk without options",
+			raw:    "GET * HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status: "400",
+		},
+		{
+			name:    "request id is echoed",
+			raw:     "GET /health HTTP/1.1\r\nHost: localhost\r\nX-Request-Id: abc-123\r\n\r\n",
+			status:  "200",
+			headers: map[string]string{"X-Request-Id": "abc-123"},
+		},
+		{
+			name:    "request id with spaces is not echoed",
+			raw:     "GET /health HTTP/1.1\r\nHost: localhost\r\nX-Request-Id: abc 123\r\n\r\n",
+			status:  "200",
+			headers: map[string]string{"X-Request-Id": ""},
+		},
+		{
+			name:    "overlong request id is not echoed",
+			raw:     "GET /health HTTP/1.1\r\nHost: localhost\r\nX-Request-Id: " + strings.Repeat("a", 129) + "\r\n\r\n",
+			status:  "200",
+			headers: map[string]string{"X-Request-Id": ""},
+		},
+		{
+			name:   "nul in header value",
+			raw:    "GET /health HTTP/1.1\r\nHost: localhost\r\nX-Request-Id: a\x00b\r\n\r\n",
+			status: "400",
+		},
+		{
+			name:   "both framing headers",
+			raw:    "POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n",
+			status: "400",
+		},
+		{
+			name:   "unknown transfer coding",
+			raw:    "POST /echo HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip\r\n\r\n",
+			status: "501",
+		},
+		{
+			name:   "conflicting content-length",
+			raw:    "POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n",
+			status: "400",
+		},
+		{
+			name:   "greet trailing slash",
+			raw:    "GET /greet/2306216636/ HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status: "200",
+		},
+		{
+			name:   "greet other npm",
+			raw:    "GET /greet/123 HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status: "404",
+		},
+		{
+			name:   "unknown path",
+			raw:    "GET /missing HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status: "404",
+		},
+		{
+			name:    "method not allowed",
+			raw:     "DELETE /echo HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status:  "405",
+			headers: map[string]string{"Allow": "GET, HEAD, POST, PUT, OPTIONS"},
+		},
+		{
+			name:    "put to a get and post route",
+			raw:     "PUT /admin/routes HTTP/1.1\r\nHost: localhost\r\nContent-Length: 0\r\n\r\n",
+			status:  "405",
+			headers: map[string]string{"Allow": "GET, HEAD, POST, OPTIONS"},
+		},
+		{
+			name:    "options on a get and post route",
+			raw:     "OPTIONS /admin/routes HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			status:  "204",
+			headers: map[string]string{"Allow": "GET, HEAD, POST, OPTIONS"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := serveRaw(tt.raw)
+			if res.StatusCode != tt.status {
+				t.Fatalf("StatusCode = %q, want %q (body %q)", res.StatusCode, tt.status, res.Data)
+			}
+			if tt.contentType != "" && res.ContentType != tt.contentType {
+				t.Errorf("ContentType = %q, want %q", res.ContentType, tt.contentType)
+			}
+			for name, value := range tt.headers {
+				if res.Headers[name] != value {
+					t.Errorf("header %s = %q, want %q", name, res.Headers[name], value)
+				}
+			}
+			if tt.body != "" && string(res.Data) != tt.body {
+				t.Errorf("Data = %q, want %q", res.Data, tt.body)
+			}
+		})
+	}
+}
+
+func TestEchoBinaryBody(t *testing.T) {
+	body := make([]byte, 3*256)
+	for i := range body {
+		body[i] = byte(i)
+	}
+	raw := "POST /echo HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nContent-Type: application/octet-stream\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + string(body)
+
+	head, data, ok := strings.Cut(serveConn(t, raw), "\r\n\r\n")
+	if !ok || !strings.HasPrefix(head, "HTTP/1.1 200 ") {
+		t.Fatalf("response head = %q", head)
+	}
+	if !bytes.Equal([]byte(data), body) {
+		t.Errorf("echoed %d bytes, want the %d bytes sent", len(data), len(body))
+	}
+}
+
+func TestJSONEscapeHTML(t *testing.T) {
+	defer func(escape bool) { jsonEscapeHTML = escape }(jsonEscapeHTML)
+
+	tests := []struct {
+		name   string
+		flag   bool
+		query  string
+		status string
+		want   string
+	}{
+		{"escaped by default", true, "", "200", `"Greeter":"\u003cBudi\u003e"`},
+		{"query disables escaping", true, "&escape_html=false", "200", `"Greeter":"<Budi>"`},
+		{"flag disables escaping", false, "", "200", `"Greeter":"<Budi>"`},
+		{"query overrides flag", false, "&escape_html=true", "200", `"Greeter":"\u003cBudi\u003e"`},
+		{"invalid query", true, "&escape_html=maybe", "400", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jsonEscapeHTML = tt.flag
+			res := serveRaw("GET /greet/2306216636?name=%3CBudi%3E" + tt.query + " HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\n\r\n")
+			if res.StatusCode != tt.status {
+				t.Fatalf("StatusCode = %q, want %q (body %q)", res.StatusCode, tt.status, res.Data)
+			}
+			if !strings.Contains(string(res.Data), tt.want) {
+				t.Errorf("Data = %s, want it to contain %s", res.Data, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadBodyUntilEOF(t *testing.T) {
+	defer func(lenient bool, body int) { lenientEOFBody, maxBodyBytes = lenient, body }(lenientEOFBody, maxBodyBytes)
+	maxBodyBytes = 8
+
+	tests := []struct {
+		name       string
+		lenient    bool
+		raw        string
+		status     string
+		body       string
+		rest       string
+		connection string
+	}{
+		{"strict leaves the body empty", false, "POST /echo HTTP/1.1\r\nHost: localhost\r\n\r\nhello", "", "", "hello", ""},
+		{"lenient reads to EOF", true, "POST /echo HTTP/1.1\r\nHost: localhost\r\n\r\nhello", "", "hello", "", "close"},
+		{"lenient caps the body", true, "POST /echo HTTP/1.1\r\nHost: localhost\r\n\r\nhello world", "413", "", "", ""},
+		{"lenient keeps content-length framing", true, "POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nhello", "", "hel", "lo", ""},
+		{"lenient ignores GET", true, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\nhello", "", "", "hello", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lenientEOFBody = tt.lenient
+			req, rest, err := readRequest(rawConn(t, tt.raw), nil)
+			if err != nil {
+				t.Fatalf("readRequest() error = %v", err)
+			}
+			if req.DecodeError.StatusCode != tt.status {
+				t.Fatalf("DecodeError = %v, want status %q", req.DecodeError, tt.status)
+			}
+			if string(req.Body) != tt.body || string(rest) != tt.rest {
+				t.Errorf("Body = %q, rest = %q; want %q, %q", req.Body, rest, tt.body, tt.rest)
+			}
+			if req.Connection != tt.connection {
+				t.Errorf("Connection = %q, want %q", req.Connection, tt.connection)
+			}
+		})
+	}
+}
+
+func TestCompressBody(t *testing.T) {
+	data := bytes.Repeat([]byte("Halo, dunia! "), 100)
+
+	tests := []struct {
+		contentType string
+		encoding    string
+		want        string
+	}{
+		{"text/plain; charset=utf-8", "gzip", "gzip"},
+		{"application/json", "br", "br"},
+		{"image/png", "gzip", "none"},
+		{"text/plain", "none", "none"},
+	}
+
+	for _, tt := range tests {
+		if _, got := compressBody(data, tt.contentType, tt.encoding); got != tt.want {
+			t.Errorf("compressBody(%q, %q) encoding = %q, want %q", tt.contentType, tt.encoding, got, tt.want)
+		}
+	}
+
+	if _, got := compressBody([]byte("a"), "text/plain", "gzip"); got != "none" {
+		t.Errorf("tiny body encoding = %q, want none", got)
+	}
+}
+
+func TestSetCookies(t *testing.T) {
+	res := HttpResponse{
+		Version:    "HTTP/1.1",
+		StatusCode: "200",
+		Headers:    map[string]string{},
+		SetCookies: []string{"a=1", "b=2; Path=/", "c=3; HttpOnly"},
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(ResponseEncoder(res)), "\r\n") {
+		if value, ok := strings.CutPrefix(line, "Set-Cookie: "); ok {
+			lines = append(lines, value)
+		}
+	}
+	if !slices.Equal(lines, res.SetCookies) {
+		t.Errorf("Set-Cookie lines = %q, want %q", lines, res.SetCookies)
+	}
+}
+
+func TestSniffGzipBody(t *testing.T) {
+	defer func(sniff bool, body int) { sniffGzipBody, maxBodyBytes = sniff, body }(sniffGzipBody, maxBodyBytes)
+	maxBodyBytes = 64
+
+	gzipped := string(compressGzip([]byte("hello")))
+	post := func(headers, body string) string {
+		return "POST /echo HTTP/1.1\r\nHost: localhost\r\n" + headers + "Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	}
+
+	tests := []struct {
+		name   string
+		sniff  bool
+		raw    string
+		status string
+		body   string
+	}{
+		{"off by default", false, post("", gzipped), "200", gzipped},
+		{"lenient decompresses", true, post("", gzipped), "200", "hello"},
+		{"declared encoding is left alone", true, post("Content-Encoding: identity\r\n", gzipped), "200", gzipped},
+		{"plain body is left alone", true, post("", "hello"), "200", "hello"},
+		{"corrupt gzip", true, post("", "\x1f\x8bnot gzip"), "400", ""},
+		{"decompresses past the cap", true, post("", string(compressGzip(bytes.Repeat([]byte("a"), 65)))), "413", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sniffGzipBody = tt.sniff
+			res := serveRaw(tt.raw)
+			if res.StatusCode != tt.status {
+				t.Fatalf("StatusCode = %q, want %q (body %q)", res.StatusCode, tt.status, res.Data)
+			}
+			if tt.body != "" && string(res.Data) != tt.body {
+				t.Errorf("Data = %q, want %q", res.Data, tt.body)
+			}
+		})
+	}
+}
+
+func TestResponseRate(t *testing.T) {
+	defer func(rate int) { responseRate = rate }(responseRate)
+	responseRate = 1000
+
+	data := bytes.Repeat([]byte("a"), 250)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	start := time.Now()
+	go func() {
+		writeResponse(serverConn, data)
+		serverConn.Close()
+	}()
+	received, _ := io.ReadAll(clientConn)
+	elapsed := time.Since(start)
+
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received %d bytes, want %d", len(received), len(data))
+	}
+	if want := 250 * time.Millisecond; elapsed < want {
+		t.Errorf("250 bytes at 1000 bytes/sec took %v, want at least %v", elapsed, want)
+	}
+}
+
+func TestForm(t *testing.T) {
+	post := func(contentType, body string) string {
+		return "POST /form HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\nContent-Type: " + contentType + "\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	}
+
+	tests := []struct {
+		name   string
+		raw    string
+		status string
+		want   string
+	}{
+		{"name field", post("application/x-www-form-urlencoded", "name=Budi+Santoso&x=1"), "200", `"Greeter":"Budi Santoso"`},
+		{"content type parameters", post("application/x-www-form-urlencoded; charset=utf-8", "name=Budi"), "200", `"Greeter":"Budi"`},
+		{"no name field", post("application/x-www-form-urlencoded", ""), "200", `"Greeter":"Muhammad Raihan Maulana"`},
+		{"bad escape", post("application/x-www-form-urlencoded", "name=%zz"), "400", ""},
+		{"semicolon separator", post("application/x-www-form-urlencoded", "name=Budi;x=1"), "400", ""},
+		{"not a form", post("application/json", `{"name":"Budi"}`), "415", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := serveRaw(tt.raw)
+			if res.StatusCode != tt.status {
+				t.Fatalf("StatusCode = %q, want %q (body %q)", res.StatusCode, tt.status, res.Data)
+			}
+			if !strings.Contains(string(res.Data), tt.want) {
+				t.Errorf("Data = %s, want it to contain %s", res.Data, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpload(t *testing.T) {
+	defer func(dir string) { uploadDir = dir }(uploadDir)
+
+	content := []byte("hello\r\n--not-a-boundary\x00\xff")
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("note", "ignored")
+	part, _ := writer.CreateFormFile("file", "../../hello.bin")
+	part.Write(content)
+	writer.Close()
+
+	raw := "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: " + writer.FormDataContentType() + "\r\nContent-Length: " + strconv.Itoa(body.Len()) + "\r\n\r\n" + body.String()
+
+	uploadDir = ""
+	if res := serveRaw(raw); res.StatusCode != "404" {
+		t.Errorf("without -upload-dir: StatusCode = %q, want 404", res.StatusCode)
+	}
+
+	uploadDir = t.TempDir()
+	res := serveRaw(raw)
+	if res.StatusCode != "201" {
+		t.Fatalf("StatusCode = %q, want 201 (body %q)", res.StatusCode, res.Data)
+	}
+
+	var upload UploadResponse
+	if err := json.Unmarshal(res.Data, &upload); err != nil {
+		t.Fatal(err)
+	}
+	if upload.Name != "hello.bin" || upload.Size != int64(len(content)) {
+		t.Errorf("upload = %+v, want hello.bin with %d bytes", upload, len(content))
+	}
+	stored, err := os.ReadFile(filepath.Join(uploadDir, "hello.bin"))
+	if err != nil || !bytes.Equal(stored, content) {
+		t.Errorf("stored file = %q, %v; want %q", stored, err, content)
+	}
+
+	notMultipart := "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nhello"
+	if res := serveRaw(notMultipart); res.StatusCode != "415" {
+		t.Errorf("text/plain body: StatusCode = %q, want 415", res.StatusCode)
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"none", "none"},
+		{"", "none"},
+		{"gzip", "gzip"},
+		{"gzip, br", "br"},
+		{"gzip;q=1, br;q=0.5", "gzip"},
+		{"*", "br"},
+		{"zstd", "zstd"},
+		{"*;q=0.5, zstd", "zstd"},
+		{"identity", "none"},
+		{"gzip;q=0, identity;q=0", ""},
+		{"*;q=0", ""},
+		{"compress", "none"},
+	}
+
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.acceptEncoding); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		status  string
+		body    string
+		pending string
+	}{
+		{
+			name:    "content-length with pipelined request",
+			raw:     "POST /echo HTTP/1.1\r\nContent-Length: 3\r\n\r\nabcGET / HTTP/1.1\r\n\r\n",
+			body:    "abc",
+			pending: "GET / HTTP/1.1\r\n\r\n",
+		},
+		{
+			name: "chunked",
+			raw:  "POST /echo HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+			body: "abc",
+		},
+		{
+			name:   "short body",
+			raw:    "POST /echo HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc",
+			status: "400",
+		},
+		{
+			name:   "incomplete head",
+			raw:    "GET / HTTP/1.1\r\nHost: x",
+			status: "400",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, rest, err := readRequest(rawConn(t, tt.raw), nil)
+			if err != nil {
+				t.Fatalf("readRequest() error = %v", err)
+			}
+			if req.DecodeError.StatusCode != tt.status {
+				t.Fatalf("DecodeError = %v, want status %q", req.DecodeError, tt.status)
+			}
+			if tt.status == "" && (string(req.Body) != tt.body || string(rest) != tt.pending) {
+				t.Errorf("Body, rest = %q, %q, want %q, %q", req.Body, rest, tt.body, tt.pending)
+			}
+		})
+	}
+}
+
+func TestReadRequestInPieces(t *testing.T) {
+	raw := "POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello world"
+
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		defer clientConn.Close()
+		for i := 0; i < len(raw); i += 3 {
+			clientConn.Write([]byte(raw[i:min(i+3, len(raw))]))
+		}
+	}()
+
+	serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	req, rest, err := readRequest(serverConn, nil)
+	if err != nil || req.DecodeError.StatusCode != "" {
+		t.Fatalf("readRequest() = %v, %v", req.DecodeError, err)
+	}
+	if req.Host != "localhost" || string(req.Body) != "hello world" || len(rest) != 0 {
+		t.Errorf("Host = %q, Body = %q, rest = %q", req.Host, req.Body, rest)
+	}
+}
+
+func TestHandleConnectionKeepAlive(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go HandleConnection(context.Background(), serverConn)
+
+	go clientConn.Write([]byte("GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"GET /health HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+
+	var responses []byte
+	buffer := make([]byte, BUFFER_SIZE)
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, err := clientConn.Read(buffer)
+		responses = append(responses, buffer[:n]...)
+		if err != nil {
+			break
+		}
+	}
+
+	if got := strings.Count(string(responses), "HTTP/1.1 200 OK"); got != 2 {
+		t.Fatalf("got %d responses, want 2:\n%s", got, responses)
+	}
+	if !strings.Contains(string(responses), "Connection: keep-alive") || !strings.Contains(string(responses), "Connection: close") {
+		t.Errorf("responses are missing the expected Connection headers:\n%s", responses)
+	}
+}
+
+func TestNegotiateCharset(t *testing.T) {
+	tests := []struct {
+		acceptCharset string
+		want          string
+	}{
+		{"", "utf-8"},
+		{"iso-8859-1", "iso-8859-1"},
+		{"utf-8;q=0.5, us-ascii", "us-ascii"},
+		{"*", "utf-8"},
+		{"koi8-r", ""},
+	}
+
+	for _, tt := range tests {
+		if got := negotiateCharset(tt.acceptCharset); got != tt.want {
+			t.Errorf("negotiateCharset(%q) = %q, want %q", tt.acceptCharset, got, tt.want)
+		}
+	}
+}
+
+func TestRequestDecoder(t *testing.T) {
+	req := RequestDecoder([]byte("GET /greet/2306216636?name=a#top HTTP/1.1\r\n" +
+		"Host: localhost:6636\r\n" +
+		"Accept: application/json\r\n" +
+		"accept: application/xml;q=0.5\r\n" +
+		"Cookie: a=1\r\n" +
+		"Cookie: b=\"two\"\r\n" +
+		"\r\n"))
+
+	if req.Method != "GET" || req.Uri != "/greet/2306216636?name=a" || req.Version != "HTTP/1.1" {
+		t.Errorf("request line = %q %q %q", req.Method, req.Uri, req.Version)
+	}
+	if req.Host != "localhost:6636" {
+		t.Errorf("Host = %q", req.Host)
+	}
+	if want := "application/json, application/xml;q=0.5"; req.Accept != want {
+		t.Errorf("Accept = %q, want %q", req.Accept, want)
+	}
+	if got := req.Headers.Values("Accept"); len(got) != 2 {
+		t.Errorf("Headers[Accept] = %q, want both lines", got)
+	}
+	if req.Cookies["a"] != "1" || req.Cookies["b"] != "two" {
+		t.Errorf("Cookies = %v", req.Cookies)
+	}
+	if req.AcceptEncoding != defaultAcceptEncoding {
+		t.Errorf("AcceptEncoding = %q, want default %q", req.AcceptEncoding, defaultAcceptEncoding)
+	}
+
+	if empty := RequestDecoder([]byte("GET / HTTP/1.1\r\nAccept-Encoding:\r\n\r\n")); empty.AcceptEncoding != "identity" {
+		t.Errorf("empty Accept-Encoding = %q, want identity", empty.AcceptEncoding)
+	}
+}
+
+func TestChunkedThreshold(t *testing.T) {
+	defer func(threshold int) { chunkedThreshold = threshold }(chunkedThreshold)
+	chunkedThreshold = 16
+
+	tests := []struct {
+		name    string
+		size    int
+		chunked bool
+	}{
+		{"small body keeps content-length", 10, false},
+		{"large body is chunked", 100, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := bytes.Repeat([]byte("0\r\n"), tt.size/3+1)[:tt.size]
+			raw := "POST /echo HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\nContent-Length: " + strconv.Itoa(tt.size) + "\r\n\r\n" + string(body)
+
+			head, data, _ := strings.Cut(serveConn(t, raw), "\r\n\r\n")
+			if got := strings.Contains(head, "Transfer-Encoding: chunked"); got != tt.chunked {
+				t.Fatalf("chunked = %v, want %v; head:\n%s", got, tt.chunked, head)
+			}
+			if strings.Contains(head, "Content-Length:") == tt.chunked {
+				t.Errorf("Content-Length present alongside chunked = %v; head:\n%s", tt.chunked, head)
+			}
+
+			decoded := []byte(data)
+			if tt.chunked {
+				var err error
+				if decoded, _, err = dechunk(decoded); err != nil {
+					t.Fatalf("dechunk() error = %v", err)
+				}
+			}
+			if !bytes.Equal(decoded, body) {
+				t.Errorf("body = %q, want %q", decoded, body)
+			}
+		})
+	}
+}
+
+func TestConnectionCaps(t *testing.T) {
+	// Restored by the first cleanup, so after every connection has ended.
+	keepAlive, connections := maxKeepAlive, maxConnections
+	t.Cleanup(func() { maxKeepAlive, maxConnections = keepAlive, connections })
+	maxKeepAlive = 1
+	maxConnections = 2
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		clientConn, serverConn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			HandleConnection(context.Background(), serverConn)
+			close(done)
+		}()
+		t.Cleanup(func() {
+			clientConn.Close()
+			<-done
+		})
+		clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+		return clientConn, bufio.NewReader(clientConn)
+	}
+	get := func(conn net.Conn, reader *bufio.Reader) *http.Response {
+		t.Helper()
+		go conn.Write([]byte("GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("ReadResponse() error = %v", err)
+		}
+		io.Copy(io.Discard, res.Body)
+		return res
+	}
+
+	first, firstReader := dial()
+	if res := get(first, firstReader); res.Header.Get("Connection") != "keep-alive" {
+		t.Fatalf("first connection: Connection = %q, want keep-alive", res.Header.Get("Connection"))
+	}
+
+	// The first connection now holds the only idle keep-alive slot.
+	second, secondReader := dial()
+	if res := get(second, secondReader); !res.Close {
+		t.Errorf("second connection over the idle cap: Connection = %q, want close", res.Header.Get("Connection"))
+	}
+	io.Copy(io.Discard, secondReader)
+
+	// An idle connection that sends its next request gives the slot back
+	// while it is served, so it can keep it.
+	if res := get(first, firstReader); res.Header.Get("Connection") != "keep-alive" {
+		t.Errorf("first connection again: Connection = %q, want keep-alive", res.Header.Get("Connection"))
+	}
+
+	// The second connection has closed, so a third fits under the total
+	// cap. Once it has sent part of a request it is certainly counted, and
+	// a fourth does not fit.
+	third, _ := dial()
+	if _, err := third.Write([]byte("GET /health HTTP/1.1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	_, fourthReader := dial()
+	res, err := http.ReadResponse(fourthReader, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse() error = %v", err)
+	}
+	if res.StatusCode != 503 || !res.Close {
+		t.Errorf("connection over the total cap: %d (close %v), want 503 with Connection: close", res.StatusCode, res.Close)
+	}
+}
+
+func TestHeadKeepsContentLength(t *testing.T) {
+	get := serveRaw("GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	head := serveRaw("HEAD /health HTTP/1.1\r\nHost: localhost\r\n\r\n")
+
+	if len(head.Data) != 0 {
+		t.Errorf("HEAD Data = %q, want none", head.Data)
+	}
+	if head.ContentLength != get.ContentLength {
+		t.Errorf("HEAD ContentLength = %d, want %d", head.ContentLength, get.ContentLength)
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"bare LF", "GET /health HTTP/1.1\r\nHost: localhost\r\nX-Request-Id: a\nSet-Cookie: evil=1\r\n\r\n"},
+		{"bare CR", "GET /health HTTP/1.1\r\nHost: localhost\r\nX-Request-Id: a\rSet-Cookie: evil=1\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := serveConn(t, tt.raw)
+			if !strings.HasPrefix(response, "HTTP/1.1 400 ") {
+				t.Errorf("response = %q, want 400", response)
+			}
+			if strings.Contains(response, "Set-Cookie") || strings.Contains(response, "X-Request-Id") {
+				t.Errorf("injected header reached the response:\n%s", response)
+			}
+		})
+	}
+}
+
+func TestFramingPolicy(t *testing.T) {
+	defer func(strict bool) { strictFraming = strict }(strictFraming)
+	raw := "POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"
+
+	strictFraming = true
+	req, _, _ := readRequest(rawConn(t, raw), nil)
+	if req.DecodeError.StatusCode != "400" {
+		t.Errorf("strict: DecodeError = %v, want 400", req.DecodeError)
+	}
+
+	strictFraming = false
+	req, rest, _ := readRequest(rawConn(t, raw), nil)
+	if req.DecodeError.StatusCode != "" || string(req.Body) != "hello" || len(rest) != 0 {
+		t.Errorf("lenient: DecodeError = %v, Body = %q, rest = %q; want the chunked body", req.DecodeError, req.Body, rest)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	named := func(name string) HandlerFunc {
+		return func(req HttpRequest) HttpResponse {
+			data := name
+			for _, key := range []string{"id", "name"} {
+				if value, ok := req.Params[key]; ok {
+					data += " " + key + "=" + value
+				}
+			}
+			return HttpResponse{Version: "HTTP/1.1", StatusCode: "200", Data: []byte(data)}
+		}
+	}
+
+	r := &Router{}
+	r.Handle("GET", "/users/me", named("me"))
+	r.Handle("GET", "/users/:id", named("user"))
+	r.Handle("GET", "/users/:id/posts", named("posts"))
+	r.Handle("POST", "/users/:id", named("update"))
+	r.Handle("*", "/any", named("any"))
+	r.Handle("GET", "/:name", named("catch-all"))
+	r.Handle("GET", "/shadowed", named("never"))
+
+	tests := []struct {
+		method string
+		path   string
+		status string
+		data   string
+	}{
+		{"GET", "/users/me", "200", "me"},
+		{"GET", "/users/42", "200", "user id=42"},
+		{"POST", "/users/42", "200", "update id=42"},
+		{"GET", "/users/42/posts", "200", "posts id=42"},
+		{"DELETE", "/any", "200", "any"},
+		{"GET", "/shadowed", "200", "catch-all name=shadowed"},
+		{"DELETE", "/users/42", "405", ""},
+		{"GET", "/users/42/posts/7", "404", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			res := r.ServeRequest(HttpRequest{Method: tt.method, Uri: tt.path, Version: "HTTP/1.1", Headers: HttpHeaders{}})
+			if res.StatusCode != tt.status {
+				t.Fatalf("StatusCode = %q, want %q", res.StatusCode, tt.status)
+			}
+			if tt.data != "" && string(res.Data) != tt.data {
+				t.Errorf("Data = %q, want %q", res.Data, tt.data)
+			}
+		})
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	defer func(proxies []*net.IPNet) { trustedProxies = proxies }(trustedProxies)
+	_, proxyNet, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name    string
+		proxies []*net.IPNet
+		peer    string
+		want    string
+	}{
+		{"direct peer", nil, "203.0.113.7:50000", "203.0.113.7"},
+		{"forwarded by a trusted proxy", []*net.IPNet{proxyNet}, "10.0.0.1:50000", "198.51.100.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trustedProxies = tt.proxies
+			logged := captureAccessLog(t)
+			peer, _ := net.ResolveTCPAddr("tcp", tt.peer)
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			done := make(chan struct{})
+			go func() {
+				HandleConnection(context.Background(), addrConn{Conn: serverConn, remote: peer})
+				close(done)
+			}()
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			go clientConn.Write([]byte("GET /health HTTP/1.1\r\nHost: localhost\r\nX-Forwarded-For: 198.51.100.9\r\nConnection: close\r\n\r\n"))
+			io.ReadAll(clientConn)
+			<-done
+
+			if !strings.HasPrefix(logged.String(), tt.want+" \"GET /health") {
+				t.Errorf("access log = %q, want RemoteAddr %s", logged, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		params  map[string]string
+		ok      bool
+	}{
+		{"/greet/:npm", "/greet/2306216636", map[string]string{"npm": "2306216636"}, true},
+		{"/greet/:npm", "/greet/2306216636/", map[string]string{"npm": "2306216636"}, true},
+		{"/greet/:npm", "/greet/", nil, false},
+		{"/greet/:npm", "/greet", nil, false},
+		{"/greet/:npm", "/greet/1/2", nil, false},
+		{"/greet/:npm", "/hello/1", nil, false},
+		{"/:a/:b", "/x/y", map[string]string{"a": "x", "b": "y"}, true},
+		{"/", "/", map[string]string{}, true},
+		{"/", "/health", nil, false},
+		{"/health", "/health/", map[string]string{}, true},
+		{"/health", "/health//", nil, false},
+	}
+
+	for _, tt := range tests {
+		params, ok := matchPath(tt.pattern, tt.path)
+		if ok != tt.ok || (ok && !maps.Equal(params, tt.params)) {
+			t.Errorf("matchPath(%q, %q) = %v, %v; want %v, %v", tt.pattern, tt.path, params, ok, tt.params, tt.ok)
+		}
+	}
+}
+
+func TestBrotliRoundTrip(t *testing.T) {
+	// A long name makes the greeting large enough to be worth compressing.
+	request := "GET /greet/2306216636?name=" + strings.Repeat("Budi", 64) + " HTTP/1.1\r\nHost: localhost\r\nAccept: application/json\r\n"
+	plain := serveRaw(request + "\r\n")
+	res := serveRaw(request + "Accept-Encoding: br\r\n\r\n")
+	if res.ContentEncoding != "br" {
+		t.Fatalf("ContentEncoding = %q, want br", res.ContentEncoding)
+	}
+
+	decoded, err := io.ReadAll(brotli.NewReader(bytes.NewReader(res.Data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, plain.Data) {
+		t.Errorf("br body decodes to %q, want %q", decoded, plain.Data)
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	defer func(proxies []*net.IPNet) { trustedProxies = proxies }(trustedProxies)
+	_, proxyNet, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies = []*net.IPNet{proxyNet}
+
+	tests := []struct {
+		name string
+		peer string
+		xff  []string
+		want string
+	}{
+		{"untrusted peer without header", "203.0.113.7:4000", nil, "203.0.113.7"},
+		{"untrusted peer cannot spoof", "203.0.113.7:4000", []string{"198.51.100.9"}, "203.0.113.7"},
+		{"trusted peer without header", "10.0.0.1:4000", nil, "10.0.0.1"},
+		{"trusted peer", "10.0.0.1:4000", []string{"198.51.100.9"}, "198.51.100.9"},
+		{"rightmost untrusted hop", "10.0.0.1:4000", []string{"1.2.3.4, 198.51.100.9, 10.0.0.2"}, "198.51.100.9"},
+		{"hops across header lines", "10.0.0.1:4000", []string{"1.2.3.4", "198.51.100.9"}, "198.51.100.9"},
+		{"only trusted hops", "10.0.0.1:4000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"stops at a malformed hop", "10.0.0.1:4000", []string{"198.51.100.9, bogus, 10.0.0.2"}, "10.0.0.2"},
+		{"ipv6 peer", "[2001:db8::1]:4000", []string{"198.51.100.9"}, "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer, err := net.ResolveTCPAddr("tcp", tt.peer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := HttpRequest{Headers: HttpHeaders{}}
+			if tt.xff != nil {
+				req.Headers["X-Forwarded-For"] = tt.xff
+			}
+			if got := clientAddr(req, peer); got != tt.want {
+				t.Errorf("clientAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	// Cleanups run last-registered first, so these settings are restored
+	// only after every connection below has finished.
+	request, read, idle, routes := requestTimeout, readTimeout, keepAliveTimeout, router.routes
+	t.Cleanup(func() {
+		requestTimeout, readTimeout, keepAliveTimeout, router.routes = request, read, idle, routes
+	})
+	requestTimeout = 100 * time.Millisecond
+	readTimeout = time.Second
+	keepAliveTimeout = time.Second
+
+	// The timed-out handler outlives its connection; wait for it too.
+	release, finished := make(chan struct{}), make(chan struct{})
+	t.Cleanup(func() {
+		close(release)
+		<-finished
+	})
+	router.Handle("GET", "/slow", func(req HttpRequest) HttpResponse {
+		defer close(finished)
+		<-release
+		return handleHealth(req)
+	})
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		clientConn, serverConn := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			HandleConnection(context.Background(), serverConn)
+			close(done)
+		}()
+		t.Cleanup(func() {
+			clientConn.Close()
+			<-done
+		})
+		clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+		return clientConn, bufio.NewReader(clientConn)
+	}
+	status := func(reader *bufio.Reader) int {
+		t.Helper()
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("ReadResponse() error = %v", err)
+		}
+		io.Copy(io.Discard, res.Body)
+		return res.StatusCode
+	}
+
+	t.Run("slow handler", func(t *testing.T) {
+		conn, reader := dial()
+		start := time.Now()
+		go conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		if got := status(reader); got != 503 {
+			t.Errorf("status = %d, want 503", got)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("timeout response took %v", elapsed)
+		}
+	})
+
+	t.Run("slow read", func(t *testing.T) {
+		conn, reader := dial()
+		go func() {
+			conn.Write([]byte("POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\n"))
+			for _, b := range []byte("hello") {
+				time.Sleep(40 * time.Millisecond)
+				if _, err := conn.Write([]byte{b}); err != nil {
+					return
+				}
+			}
+		}()
+		if got := status(reader); got != 503 {
+			t.Errorf("status = %d, want 503", got)
+		}
+	})
+
+	t.Run("budget is per request", func(t *testing.T) {
+		conn, reader := dial()
+		for i := 0; i < 2; i++ {
+			go conn.Write([]byte("GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+			if got := status(reader); got != 200 {
+				t.Fatalf("request %d: status = %d, want 200", i+1, got)
+			}
+			// Idle time between requests does not count against the next.
+			time.Sleep(150 * time.Millisecond)
+		}
+	})
+}
+
+func TestZstdOnlyWhenAccepted(t *testing.T) {
+	for _, acceptEncoding := range []string{"*", "gzip, deflate, br", "*;q=1, gzip;q=0, br;q=0, deflate;q=0", "identity", ""} {
+		if got := negotiateEncoding(acceptEncoding); got == "zstd" {
+			t.Errorf("negotiateEncoding(%q) = zstd without zstd being listed", acceptEncoding)
+		}
+	}
+
+	// Absent Accept-Encoding falls back to -default-accept-encoding.
+	res := serveRaw("GET /gzip-test?size=4096 HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if res.ContentEncoding == "zstd" {
+		t.Errorf("request without Accept-Encoding got zstd")
+	}
+	res = serveRaw("GET /gzip-test?size=4096 HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: *\r\n\r\n")
+	if res.ContentEncoding == "zstd" {
+		t.Errorf("Accept-Encoding: * got zstd")
+	}
+}
+
+func TestDebugRuntime(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+	get := func(authorization string) HttpResponse {
+		return serveRaw("GET /debug/runtime HTTP/1.1\r\nHost: localhost\r\nAuthorization: " + authorization + "\r\n\r\n")
+	}
+
+	adminToken = ""
+	if res := get("Bearer s3cret"); res.StatusCode != "404" {
+		t.Errorf("without -admin-token: StatusCode = %q, want 404", res.StatusCode)
+	}
+
+	adminToken = "s3cret"
+	if res := get("Bearer wrong"); res.StatusCode != "401" {
+		t.Errorf("wrong token: StatusCode = %q, want 401", res.StatusCode)
+	}
+
+	res := get("Bearer s3cret")
+	if res.StatusCode != "200" {
+		t.Fatalf("StatusCode = %q, want 200 (body %q)", res.StatusCode, res.Data)
+	}
+
+	var stats map[string]interface{}
+	if err := json.Unmarshal(res.Data, &stats); err != nil {
+		t.Fatalf("body %q is not JSON: %v", res.Data, err)
+	}
+	for _, field := range []string{"goroutines", "active_connections", "keep_alive_connections", "heap_alloc_bytes", "heap_objects", "total_alloc_bytes", "sys_bytes", "num_gc"} {
+		value, ok := stats[field].(float64)
+		if !ok || value < 0 {
+			t.Errorf("%s = %v, want a non-negative number", field, stats[field])
+		}
+	}
+	if goroutines, _ := stats["goroutines"].(float64); goroutines < 1 {
+		t.Errorf("goroutines = %v, want at least 1", stats["goroutines"])
+	}
+}
+
+func TestDechunk(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		want     string
+		consumed int
+		err      error
+		wantErr  bool
+	}{
+		{name: "complete", data: "5\r\nhello\r\n0\r\n\r\nrest", want: "hello", consumed: 15},
+		{name: "extension and trailer", data: "2;x=y\r\nhi\r\n0\r\nX-Checksum: 1\r\n\r\n", want: "hi", consumed: 31},
+		{name: "incomplete", data: "5\r\nhel", err: errIncompleteChunk},
+		{name: "bad size", data: "zz\r\n", wantErr: true},
+		{name: "signed size", data: "+5\r\nhello\r\n0\r\n\r\n", wantErr: true},
+		{name: "prefixed size", data: "0x5\r\nhello\r\n0\r\n\r\n", wantErr: true},
+		{name: "empty size", data: "\r\n", wantErr: true},
+		{name: "oversized size", data: "fffffffffffffffff\r\n", wantErr: true},
+		{name: "missing crlf", data: "2\r\nhiX\r\n", wantErr: true},
+		{name: "forbidden trailer", data: "0\r\nContent-Length: 5\r\n\r\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, consumed, err := dechunk([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil || err == errIncompleteChunk {
+					t.Fatalf("dechunk() error = %v, want a framing error", err)
+				}
+				return
+			}
+			if err != tt.err {
+				t.Fatalf("dechunk() error = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && (string(got) != tt.want || consumed != tt.consumed) {
+				t.Errorf("dechunk() = %q, %d, want %q, %d", got, consumed, tt.want, tt.consumed)
+			}
+		})
+	}
+}
+
+func TestHealthUptime(t *testing.T) {
+	defer func(now func() time.Time) { timeNow = now }(timeNow)
+	timeNow = func() time.Time { return startTime.Add(90 * time.Second) }
+
+	res := serveRaw("GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if want := `{"status":"ok","uptime_seconds":90}`; string(res.Data) != want {
+		t.Errorf("Data = %q, want %q", res.Data, want)
+	}
+}
+
+func TestReadWithFinalEOF(t *testing.T) {
+	large := strings.Repeat("a", 3*BUFFER_SIZE)
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"one read", "hello"},
+		{"several reads", large},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: " + strconv.Itoa(len(tt.body)) + "\r\n\r\n" + tt.body
+			req, _, err := readRequest(&dataEOFConn{data: []byte(raw)}, nil)
+			if err != nil || req.DecodeError.StatusCode != "" {
+				t.Fatalf("readRequest() = %v, %v", req.DecodeError, err)
+			}
+			if string(req.Body) != tt.body {
+				t.Errorf("Body = %d bytes, want %d", len(req.Body), len(tt.body))
+			}
+		})
+	}
+
+	conn := &dataEOFConn{data: []byte("GET /health HTTP/1.1\r\nHost: localhost\r\n\r\n")}
+	HandleConnection(context.Background(), conn)
+	if !strings.HasPrefix(conn.written.String(), "HTTP/1.1 200 ") {
+		t.Errorf("HandleConnection() wrote %q, want a 200 response", conn.written.String())
+	}
+}
+
+// serveConn runs HandleConnection over a pipe, sends raw and returns
+// everything written back once the server closes the connection.
+func serveConn(t *testing.T, raw string) string {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		HandleConnection(context.Background(), serverConn)
+		close(done)
+	}()
+
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	go clientConn.Write([]byte(raw))
+	response, _ := io.ReadAll(clientConn)
+	<-done
+	return string(response)
+}
+
+// captureAccessLog sends access log lines to a buffer for the test's duration.
+func captureAccessLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	accessLog.out = &buf
+	t.Cleanup(func() { accessLog.out = nil })
+	return &buf
+}
+
+// addrConn reports remote as its peer address.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+// dataEOFConn hands out its data in reads of at most len(p) bytes and
+// returns io.EOF together with the last of them, as net.Conn allows.
+type dataEOFConn struct {
+	net.Conn
+	data    []byte
+	written bytes.Buffer
+}
+
+func (c *dataEOFConn) Read(p []byte) (int, error) {
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	if len(c.data) == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *dataEOFConn) Write(p []byte) (int, error)        { return c.written.Write(p) }
+func (c *dataEOFConn) Close() error                       { return nil }
+func (c *dataEOFConn) RemoteAddr() net.Addr               { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c *dataEOFConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dataEOFConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dataEOFConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// rawConn returns a connection that yields raw and then EOF.
+func rawConn(t *testing.T, raw string) net.Conn {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	go func() {
+		clientConn.Write([]byte(raw))
+		clientConn.Close()
+	}()
+	t.Cleanup(func() { serverConn.Close() })
+	return serverConn
+}